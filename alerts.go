@@ -0,0 +1,486 @@
+package iotedge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AlertKindThreshold string = "threshold"
+	AlertKindNoData    string = "nodata"
+
+	AlertFiring   string = "firing"
+	AlertResolved string = "resolved"
+)
+
+// noDataCheckInterval is how often nodata rules are evaluated.
+const noDataCheckInterval = 30 * time.Second
+
+// AlertRule either watches the values of a tag (threshold) or the silence of
+// a device (nodata). A threshold rule fires once the condition held for
+// ForSeconds, a nodata rule once the device missed Intervals intervals.
+type AlertRule struct {
+	ID         int
+	Name       string
+	Kind       string
+	Tag        string
+	Device     string
+	Operator   string
+	Threshold  float64
+	ForSeconds int
+	Intervals  int
+}
+
+type AlertEvent struct {
+	Rule  AlertRule
+	State string
+	Value float64
+	Time  time.Time
+}
+
+type AlertStatus struct {
+	Rule  AlertRule
+	State string
+	Since *time.Time `json:",omitempty"`
+}
+
+// AlertSink receives state transitions of alert rules.
+type AlertSink interface {
+	Notify(event AlertEvent) error
+}
+
+// WebhookSink posts each event as JSON to URL.
+type WebhookSink struct {
+	URL string
+}
+
+func (w *WebhookSink) Notify(event AlertEvent) error {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Post(w.URL, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook failed with status: %s", resp.Status)
+	}
+	return nil
+}
+
+type alertState struct {
+	pendingSince time.Time
+	firingSince  time.Time
+	firing       bool
+}
+
+type AlertEngine struct {
+	deviceDB  *DeviceDB
+	config    IoTConfig
+	mutex     sync.Mutex
+	rules     []AlertRule
+	states    map[int]*alertState
+	sinks     []AlertSink
+	isRunning bool
+}
+
+var onceAlertEngine sync.Once
+var alertEngine *AlertEngine
+
+// GetAlertEngine returns the engine shared by the HTTP and MQTT ingest paths
+// so rule state isn't tracked twice.
+func GetAlertEngine(config IoTConfig) *AlertEngine {
+	logger := log.WithFields(log.Fields{"fnct": "GetAlertEngine"})
+	onceAlertEngine.Do(func() {
+		logger.Infoln("init")
+		devDB := GetDeviceDB(config.DbConfig)
+		alertEngine = &AlertEngine{
+			deviceDB: devDB,
+			config:   config,
+			states:   make(map[int]*alertState),
+		}
+		sqlStr := `CREATE TABLE IF NOT EXISTS alert_rules (
+			` + devDB.idColumn() + ` ,
+			name        TEXT NOT NULL,
+			kind        TEXT NOT NULL,
+			tag         TEXT DEFAULT '',
+			device      TEXT DEFAULT '',
+			operator    TEXT DEFAULT '>',
+			threshold   ` + devDB.numericType() + ` DEFAULT 0,
+			for_seconds INTEGER DEFAULT 0,
+			intervals   INTEGER DEFAULT 0
+		   );
+		 `
+		if _, err := devDB.ExecuteQuery(sqlStr); err != nil {
+			logger.Fatalf("failed to create alert_rules table:%v", err)
+		}
+		if err := alertEngine.loadRules(); err != nil {
+			logger.Fatalf("failed to load alert rules:%v", err)
+		}
+		for _, url := range config.AlertWebhooks {
+			alertEngine.AddSink(&WebhookSink{URL: url})
+		}
+	})
+	return alertEngine
+}
+
+func (e *AlertEngine) AddSink(sink AlertSink) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.sinks = append(e.sinks, sink)
+}
+
+func (e *AlertEngine) loadRules() error {
+	rows, err := e.deviceDB.ExecuteQuery(`SELECT id, name, kind, tag, device, operator,
+		threshold, for_seconds, intervals FROM alert_rules ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	rules := []AlertRule{}
+	for rows.Next() {
+		var r AlertRule
+		if err := rows.Scan(&r.ID, &r.Name, &r.Kind, &r.Tag, &r.Device, &r.Operator,
+			&r.Threshold, &r.ForSeconds, &r.Intervals); err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.rules = rules
+	return nil
+}
+
+func (e *AlertEngine) Rules() []AlertRule {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]AlertRule{}, e.rules...)
+}
+
+func validateRule(rule AlertRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("rule needs a name")
+	}
+	switch rule.Kind {
+	case AlertKindThreshold:
+		if rule.Tag == "" {
+			return fmt.Errorf("threshold rule needs a tag")
+		}
+		if _, err := compare(rule.Operator, 0, 0); err != nil {
+			return err
+		}
+	case AlertKindNoData:
+		if rule.Device == "" || rule.Intervals <= 0 {
+			return fmt.Errorf("nodata rule needs a device and intervals")
+		}
+	default:
+		return fmt.Errorf("unknown rule kind '%s'", rule.Kind)
+	}
+	return nil
+}
+
+func (e *AlertEngine) AddRule(rule AlertRule) (AlertRule, error) {
+	logFields := log.Fields{"fnct": "AddRule", "rule": rule.Name}
+	if err := validateRule(rule); err != nil {
+		return rule, err
+	}
+	rows, err := e.deviceDB.ExecuteQuery(`INSERT INTO alert_rules
+		(name, kind, tag, device, operator, threshold, for_seconds, intervals)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		rule.Name, rule.Kind, rule.Tag, rule.Device, rule.Operator, rule.Threshold,
+		rule.ForSeconds, rule.Intervals)
+	if err != nil {
+		log.WithFields(logFields).Errorf("insert failed: %v", err)
+		return rule, err
+	}
+	if rows.Next() {
+		if err := rows.Scan(&rule.ID); err != nil {
+			rows.Close()
+			return rule, err
+		}
+	}
+	rows.Close()
+	log.WithFields(logFields).Infof("Added rule %d", rule.ID)
+	return rule, e.loadRules()
+}
+
+func (e *AlertEngine) DeleteRule(id int) error {
+	logFields := log.Fields{"fnct": "DeleteRule", "id": id}
+	if _, err := e.deviceDB.ExecuteQuery("DELETE FROM alert_rules WHERE id = ?", id); err != nil {
+		log.WithFields(logFields).Errorf("delete failed: %v", err)
+		return err
+	}
+	e.mutex.Lock()
+	delete(e.states, id)
+	e.mutex.Unlock()
+	return e.loadRules()
+}
+
+func compare(operator string, value float64, threshold float64) (bool, error) {
+	switch operator {
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case "==":
+		return value == threshold, nil
+	case "!=":
+		return value != threshold, nil
+	}
+	return false, fmt.Errorf("unknown operator '%s'", operator)
+}
+
+func (e *AlertEngine) state(ruleID int) *alertState {
+	st, ok := e.states[ruleID]
+	if !ok {
+		st = &alertState{}
+		e.states[ruleID] = st
+	}
+	return st
+}
+
+// transition updates the rule state and returns the event if the rule
+// started or stopped firing. Callers hold the mutex.
+func (e *AlertEngine) transition(rule AlertRule, active bool, at time.Time, value float64, holdFor time.Duration) *AlertEvent {
+	st := e.state(rule.ID)
+	if !active {
+		st.pendingSince = time.Time{}
+		if st.firing {
+			st.firing = false
+			return &AlertEvent{Rule: rule, State: AlertResolved, Value: value, Time: at}
+		}
+		return nil
+	}
+	if st.pendingSince.IsZero() {
+		st.pendingSince = at
+	}
+	if !st.firing && at.Sub(st.pendingSince) >= holdFor {
+		st.firing = true
+		st.firingSince = at
+		return &AlertEvent{Rule: rule, State: AlertFiring, Value: value, Time: at}
+	}
+	return nil
+}
+
+// Evaluate checks a single value against the threshold rules of its tag.
+func (e *AlertEngine) Evaluate(tag string, at time.Time, value float64) {
+	var events []AlertEvent
+	e.mutex.Lock()
+	for _, rule := range e.rules {
+		if rule.Kind != AlertKindThreshold || rule.Tag != tag {
+			continue
+		}
+		active, err := compare(rule.Operator, value, rule.Threshold)
+		if err != nil {
+			continue
+		}
+		holdFor := time.Duration(rule.ForSeconds) * time.Second
+		if event := e.transition(rule, active, at, value, holdFor); event != nil {
+			events = append(events, *event)
+		}
+	}
+	e.mutex.Unlock()
+	e.dispatch(events)
+}
+
+// EvaluateTimeseries evaluates all values of ts; unparsable timestamps are
+// treated as now.
+func (e *AlertEngine) EvaluateTimeseries(ts timeseries.TimeseriesImportStruct) {
+	for i, val := range ts.Values {
+		value, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			continue
+		}
+		at := time.Now().UTC()
+		if i < len(ts.Timestamps) {
+			if parsed, err := ParseTimestamp(ts.Timestamps[i]); err == nil {
+				at = parsed
+			}
+		}
+		e.Evaluate(ts.Tag, at, value)
+	}
+}
+
+// CheckNoData evaluates the nodata rules against the devices' last_seen.
+func (e *AlertEngine) CheckNoData(now time.Time) {
+	logFields := log.Fields{"fnct": "CheckNoData"}
+	var events []AlertEvent
+	for _, rule := range e.Rules() {
+		if rule.Kind != AlertKindNoData {
+			continue
+		}
+		dev, err := e.deviceDB.GetDevice(rule.Device)
+		if err != nil {
+			log.WithFields(logFields).Warnf("rule %s: %v", rule.Name, err)
+			continue
+		}
+		silence := time.Duration(float64(rule.Intervals) * float64(dev.Interval) * float64(time.Second))
+		silence = max(silence, dev.UploadPeriod())
+		active := dev.LastSeen == nil || now.Sub(*dev.LastSeen) > silence
+		e.mutex.Lock()
+		event := e.transition(rule, active, now, 0, 0)
+		e.mutex.Unlock()
+		if event != nil {
+			events = append(events, *event)
+		}
+	}
+	e.dispatch(events)
+}
+
+// RunNoDataChecks checks the nodata rules periodically until stop is closed.
+// Only one loop runs per process.
+func (e *AlertEngine) RunNoDataChecks(stop <-chan struct{}) {
+	e.mutex.Lock()
+	if e.isRunning {
+		e.mutex.Unlock()
+		return
+	}
+	e.isRunning = true
+	e.mutex.Unlock()
+	defer func() {
+		e.mutex.Lock()
+		e.isRunning = false
+		e.mutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(noDataCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			e.CheckNoData(now.UTC())
+		}
+	}
+}
+
+func (e *AlertEngine) Status() []AlertStatus {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	status := []AlertStatus{}
+	for _, rule := range e.rules {
+		st := AlertStatus{Rule: rule, State: AlertResolved}
+		if s, ok := e.states[rule.ID]; ok && s.firing {
+			since := s.firingSince
+			st.State = AlertFiring
+			st.Since = &since
+		}
+		status = append(status, st)
+	}
+	return status
+}
+
+// dispatch records the transitions in the logs table and notifies the sinks.
+func (e *AlertEngine) dispatch(events []AlertEvent) {
+	if len(events) == 0 {
+		return
+	}
+	e.mutex.Lock()
+	sinks := append([]AlertSink{}, e.sinks...)
+	e.mutex.Unlock()
+	for _, event := range events {
+		msg := LogMessage{
+			Device: event.Rule.Device,
+			Text:   alertText(event),
+			Level:  Warning,
+		}
+		if msg.Device == "" {
+			msg.Device = event.Rule.Tag
+		}
+		if event.State == AlertResolved {
+			msg.Level = Info
+		}
+		logger := log.WithFields(log.Fields{"fnct": "dispatch", "rule": event.Rule.Name})
+		logger.Warnln(msg.Text)
+		if err := GetLoggingDB(e.config.DbConfig).InsertLogMessage(msg); err != nil {
+			logger.Errorf("failed to log alert: %v", err)
+		}
+		for _, sink := range sinks {
+			go func(sink AlertSink, event AlertEvent) {
+				if err := sink.Notify(event); err != nil {
+					logger.Errorf("failed to notify sink: %v", err)
+				}
+			}(sink, event)
+		}
+	}
+}
+
+func alertText(event AlertEvent) string {
+	r := event.Rule
+	if r.Kind == AlertKindNoData {
+		return fmt.Sprintf("alert '%s' %s: no data from %s for %d intervals", r.Name, event.State, r.Device, r.Intervals)
+	}
+	return fmt.Sprintf("alert '%s' %s: %s %s %v (value %v)", r.Name, event.State, r.Tag, r.Operator, r.Threshold, event.Value)
+}
+
+func (s *IoTEdge) ListAlertRules(c *gin.Context) {
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, s.Alerts.Rules())
+}
+
+func (s *IoTEdge) AddAlertRule(c *gin.Context) {
+	logFields := log.Fields{"fnct": "AddAlertRule"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	var rule AlertRule
+	if err := c.BindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	if err := validateRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	rule, err := s.Alerts.AddRule(rule)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("adding rule failed: %v", err)})
+		return
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, rule)
+}
+
+func (s *IoTEdge) DeleteAlertRule(c *gin.Context) {
+	logFields := log.Fields{"fnct": "DeleteAlertRule"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	if err := s.Alerts.DeleteRule(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleting rule failed: %v", err)})
+		return
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func (s *IoTEdge) ListAlerts(c *gin.Context) {
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, s.Alerts.Status())
+}
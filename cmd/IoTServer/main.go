@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	iotedge "github.com/pat-rohn/go-iotedge"
 	"github.com/pat-rohn/timeseries"
@@ -57,9 +65,9 @@ func main() {
 		Long:  ``,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			conf := iotedge.GetConfig()
-			iotedge.StartMQTTBroker(conf.MQTTPort, conf)
-
-			return nil
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return iotedge.NewMQTTEdge(conf.MQTTPort, conf).Start(ctx)
 		},
 	}
 
@@ -134,6 +142,275 @@ func main() {
 		},
 	}
 
+	var statusCmd = &cobra.Command{
+		Use:   "status",
+		Args:  cobra.MinimumNArgs(0),
+		Short: "Shows when each device was last seen and whether it is online",
+		Long:  ``,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			edge := iotedge.New(iotedge.GetConfig())
+			status, err := edge.DeviceDB.GetDeviceStatus()
+			if err != nil {
+				return err
+			}
+			printDeviceStatus(status)
+			return nil
+		},
+	}
+
+	var logsQuery iotedge.LogQuery
+	var logsLevel string
+	var logsSince time.Duration
+	var logsFollow bool
+	var logsCmd = &cobra.Command{
+		Use:   "logs",
+		Args:  cobra.MinimumNArgs(0),
+		Short: "Shows the log messages sent by the devices",
+		Long:  `Shows the latest messages, oldest first. With --follow new messages are printed until Ctrl+C.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := iotedge.GetConfig()
+			iotedge.New(config)
+			level, err := iotedge.ParseLoglevel(logsLevel)
+			if err != nil {
+				return err
+			}
+			logsQuery.MinLevel = level
+			if logsSince > 0 {
+				logsQuery.Start = time.Now().Add(-logsSince)
+			}
+			db := iotedge.GetLoggingDB(config.DbConfig)
+			messages, err := db.QueryLogMessages(logsQuery)
+			if err != nil {
+				return err
+			}
+			slices.Reverse(messages)
+			for _, msg := range messages {
+				printLogMessage(msg)
+			}
+			if !logsFollow {
+				return nil
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return followLogs(ctx, db, logsQuery, messages)
+		},
+	}
+	logsCmd.Flags().StringVarP(&logsQuery.Device, "device", "d", "", "only messages of this device")
+	logsCmd.Flags().StringVarP(&logsLevel, "level", "l", "debug", "minimum level (debug, info, warning, error)")
+	logsCmd.Flags().DurationVar(&logsSince, "since", 0, "only messages of the given time, e.g. 1h")
+	logsCmd.Flags().StringVarP(&logsQuery.Text, "grep", "g", "", "only messages containing the text")
+	logsCmd.Flags().IntVarP(&logsQuery.Limit, "limit", "n", 50, "number of messages")
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "print new messages as they arrive")
+
+	var pruneDryRun bool
+	var pruneCmd = &cobra.Command{
+		Use:   "prune",
+		Args:  cobra.MinimumNArgs(0),
+		Short: "Deletes the rows older than the retention policies allow",
+		Long:  `Applies the policies in 'Retention' of the config. With --dry-run only the rows to be deleted are counted.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			edge := iotedge.New(iotedge.GetConfig())
+			if len(edge.IoTConfig.Retention) == 0 {
+				fmt.Println("No retention policies configured")
+				return nil
+			}
+			results, err := edge.Prune(pruneDryRun)
+			printPruneResults(results, pruneDryRun)
+			return err
+		},
+	}
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "only report how many rows would be deleted")
+
+	var backfillSince time.Duration
+	var backfillCmd = &cobra.Command{
+		Use:   "backfill-rollups",
+		Args:  cobra.MinimumNArgs(0),
+		Short: "Recomputes the rollup tables from the raw data",
+		Long:  `Recomputes the rollups configured in 'Rollups' from the stored measurements, by default all of them.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := iotedge.GetConfig()
+			edge := iotedge.New(config)
+			var since time.Time
+			if backfillSince > 0 {
+				since = time.Now().Add(-backfillSince)
+			}
+			results, err := edge.DeviceDB.BackfillRollups(config.TimeseriesTable, since)
+			for _, r := range results {
+				fmt.Printf("%s: %d buckets\n", r.Table, r.Buckets)
+			}
+			return err
+		},
+	}
+	backfillCmd.Flags().DurationVar(&backfillSince, "since", 0, "only recompute the given time, e.g. 720h")
+
+	var exportQuery iotedge.TimeseriesQuery
+	var exportStart, exportEnd, exportFormat, exportOutput string
+	var exportCmd = &cobra.Command{
+		Use:   "export",
+		Args:  cobra.MinimumNArgs(0),
+		Short: "Exports stored timeseries as CSV, JSON Lines or for /timeseries/save",
+		Long: `Writes the raw values of the tags ('*' is a wildcard) to stdout or a file. The range defaults to
+the last 24 hours. The format 'timeseries' can be posted to /timeseries/save of another server.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := iotedge.GetConfig()
+			edge := iotedge.New(config)
+			exportQuery.End = time.Now()
+			if exportEnd != "" {
+				end, err := iotedge.ParseTimestamp(exportEnd)
+				if err != nil {
+					return err
+				}
+				exportQuery.End = end
+			}
+			exportQuery.Start = exportQuery.End.Add(-24 * time.Hour)
+			if exportStart != "" {
+				start, err := iotedge.ParseTimestamp(exportStart)
+				if err != nil {
+					return err
+				}
+				exportQuery.Start = start
+			}
+			out := os.Stdout
+			if exportOutput != "" && exportOutput != "-" {
+				f, err := os.Create(exportOutput)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+			count, err := edge.DeviceDB.ExportTimeseries(out, config.TimeseriesTable, exportQuery, exportFormat)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Exported %d values\n", count)
+			return nil
+		},
+	}
+	exportCmd.Flags().StringSliceVarP(&exportQuery.Tags, "tag", "t", nil, "tags to export, repeatable or comma separated")
+	exportCmd.Flags().StringVar(&exportStart, "start", "", "start of the range, e.g. 2024-01-01T00:00:00Z")
+	exportCmd.Flags().StringVar(&exportEnd, "end", "", "end of the range (exclusive), defaults to now")
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", iotedge.ExportCSV, "csv, jsonl or timeseries")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "file to write, defaults to stdout")
+	exportCmd.MarkFlagRequired("tag")
+
+	var importOpts iotedge.CSVImportOptions
+	var importDelimiter, importTimezone string
+	var importCmd = &cobra.Command{
+		Use:   "import file.csv",
+		Args:  cobra.MinimumNArgs(1),
+		Short: "Imports timeseries from a CSV file",
+		Long: `Reads a CSV file with a header line, one timestamp column and one or more value columns and stores
+the values like received data. Values that are stored already are skipped unless --replace is given.
+Use '-' to read from stdin.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := iotedge.GetConfig()
+			edge := iotedge.New(config)
+			if delimiter := []rune(importDelimiter); len(delimiter) == 1 {
+				importOpts.Delimiter = delimiter[0]
+			} else {
+				return fmt.Errorf("delimiter must be a single character")
+			}
+			loc, err := time.LoadLocation(importTimezone)
+			if err != nil {
+				return err
+			}
+			importOpts.Location = loc
+			in := os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+			importOpts.Progress = func(stats iotedge.CSVImportStats) {
+				if importOpts.DryRun {
+					fmt.Fprintf(os.Stderr, "\r%d lines, %d values read", stats.Lines, stats.Values)
+					return
+				}
+				fmt.Fprintf(os.Stderr, "\r%d lines, %d values read, %d written", stats.Lines, stats.Values, stats.Written)
+			}
+			stats, err := edge.DeviceDB.ImportCSV(in, config.TimeseriesTable, importOpts)
+			fmt.Fprintln(os.Stderr)
+			printImportStats(stats, importOpts.DryRun)
+			return err
+		},
+	}
+	importCmd.Flags().StringVar(&importOpts.TimeColumn, "time-column", "", "header of the timestamp column, defaults to the first column")
+	importCmd.Flags().StringVar(&importOpts.TimeFormat, "time-format", "",
+		"Go layout like '02.01.2006 15:04', 'unix' or 'unixms', defaults to RFC3339 and '2006-01-02 15:04:05'")
+	importCmd.Flags().StringVar(&importTimezone, "timezone", "UTC", "zone of timestamps without offset, e.g. Local or Europe/Zurich")
+	importCmd.Flags().StringToStringVarP(&importOpts.Columns, "column", "c", nil,
+		"value column and its tag, e.g. Temp=Wemos2Temperature, defaults to all columns")
+	importCmd.Flags().StringVar(&importOpts.TagPrefix, "tag-prefix", "", "prefix of the tags when the headers are used")
+	importCmd.Flags().StringVarP(&importDelimiter, "delimiter", "d", ",", "field delimiter")
+	importCmd.Flags().BoolVar(&importOpts.Replace, "replace", false, "overwrite values that are stored already")
+	importCmd.Flags().BoolVar(&importOpts.DryRun, "dry-run", false, "only read the file and report what would be imported")
+
+	var mqttPasswordCmd = &cobra.Command{
+		Use:   "mqtt-password devicename password",
+		Args:  cobra.MinimumNArgs(2),
+		Short: "Sets the password the device uses to connect to the MQTT broker",
+		Long:  `The device connects with its name as username and may only use topics below '<devicename>/'.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			edge := iotedge.New(iotedge.GetConfig())
+			return edge.DeviceDB.SetMQTTPassword(args[0], args[1])
+		},
+	}
+
+	var tokenCmd = &cobra.Command{
+		Use:   "token",
+		Short: "Manages the tokens for the HTTP API (HTTPAuth)",
+	}
+	tokenCmd.AddCommand(&cobra.Command{
+		Use:   "issue devicename",
+		Args:  cobra.MinimumNArgs(1),
+		Short: "Issues a new token for the device and invalidates the old one",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			edge := iotedge.New(iotedge.GetConfig())
+			token, err := edge.DeviceDB.IssueDeviceToken(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Println(token)
+			return nil
+		},
+	})
+	tokenCmd.AddCommand(&cobra.Command{
+		Use:   "revoke devicename",
+		Args:  cobra.MinimumNArgs(1),
+		Short: "Revokes the token of the device, an init with admin token issues a new one",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			edge := iotedge.New(iotedge.GetConfig())
+			return edge.DeviceDB.RevokeDeviceToken(args[0])
+		},
+	})
+	tokenCmd.AddCommand(&cobra.Command{
+		Use:   "issue-admin name",
+		Args:  cobra.MinimumNArgs(1),
+		Short: "Issues an admin token, an existing token with the same name is replaced",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			edge := iotedge.New(iotedge.GetConfig())
+			token, err := edge.DeviceDB.IssueAdminToken(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Println(token)
+			return nil
+		},
+	})
+	tokenCmd.AddCommand(&cobra.Command{
+		Use:   "revoke-admin name",
+		Args:  cobra.MinimumNArgs(1),
+		Short: "Revokes an admin token",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			edge := iotedge.New(iotedge.GetConfig())
+			return edge.DeviceDB.RevokeAdminToken(args[0])
+		},
+	})
+
 	rootCmd.PersistentFlags().StringVarP(&loglevel, "verbose", "v", "w", "verbosity")
 
 	rootCmd.AddCommand(startServerCmd)
@@ -141,6 +418,14 @@ func main() {
 	rootCmd.AddCommand(createTableCmd)
 	rootCmd.AddCommand(ConfigureDeviceCmd)
 	rootCmd.AddCommand(ConfigureSensorCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(pruneCmd)
+	rootCmd.AddCommand(backfillCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(mqttPasswordCmd)
+	rootCmd.AddCommand(tokenCmd)
 
 	cobra.OnInitialize(initGlobalFlags)
 	rootCmd.Execute()
@@ -157,9 +442,141 @@ func CreateTimeseriesTable() error {
 	return nil
 }
 
+func printDeviceStatus(status []iotedge.DeviceStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tSTATE\tLAST SEEN\tCONFIG")
+	for _, s := range status {
+		lastSeen := "never"
+		if s.LastSeen != nil {
+			lastSeen = fmt.Sprintf("%s (%s ago)", s.LastSeen.Local().Format(time.DateTime),
+				time.Since(*s.LastSeen).Round(time.Second))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\n", s.Name, s.State, lastSeen,
+			s.AppliedConfigVersion, s.ConfigVersion)
+	}
+	w.Flush()
+}
+
+func printLogMessage(msg iotedge.LogMessage) {
+	fmt.Printf("%s  %-7s  %s: %s\n", msg.Timestamp.Local().Format(time.DateTime), msg.Level, msg.Device, msg.Text)
+}
+
+// logFollowInterval is how often --follow polls for new messages.
+const logFollowInterval = 2 * time.Second
+
+func printPruneResults(results []iotedge.PruneResult, dryRun bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	rowsHeader := "DELETED"
+	if dryRun {
+		rowsHeader = "TO DELETE"
+	}
+	fmt.Fprintf(w, "TABLE\tTAG\tOLDER THAN\t%s\n", rowsHeader)
+	for _, r := range results {
+		tag := r.Policy.Tag
+		if tag == "" {
+			tag = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", r.Policy.Table, tag, r.Before.Local().Format(time.DateTime), r.Rows)
+	}
+	w.Flush()
+}
+
+func printImportStats(stats iotedge.CSVImportStats, dryRun bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TAG\tVALUES")
+	for _, tag := range slices.Sorted(maps.Keys(stats.Tags)) {
+		fmt.Fprintf(w, "%s\t%d\n", tag, stats.Tags[tag])
+	}
+	w.Flush()
+	if stats.Lines > 0 {
+		fmt.Printf("%d lines from %s to %s\n", stats.Lines,
+			stats.First.Local().Format(time.DateTime), stats.Last.Local().Format(time.DateTime))
+	}
+	fmt.Printf("%d values, %d empty and %d invalid cells\n", stats.Values, stats.Empty, stats.Invalid)
+	if !dryRun {
+		fmt.Printf("%d written, %d duplicates skipped\n", stats.Written, stats.Duplicates())
+	}
+}
+
+// followLogs polls for messages stored after the printed ones.
+func followLogs(ctx context.Context, db *iotedge.LoggingDB, q iotedge.LogQuery, printed []iotedge.LogMessage) error {
+	for _, msg := range printed {
+		q.AfterID = max(q.AfterID, msg.ID)
+	}
+	if q.AfterID == 0 {
+		// nothing printed yet, start with what arrives from now on
+		latest, err := db.LatestLogID()
+		if err != nil {
+			return err
+		}
+		q.AfterID = latest
+	}
+	// devices may send old timestamps, new messages are found by their ID
+	q.Start = time.Time{}
+	q.Ascending = true
+	q.Offset = 0
+	ticker := time.NewTicker(logFollowInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		messages, err := db.QueryLogMessages(q)
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			printLogMessage(msg)
+			q.AfterID = msg.ID
+		}
+	}
+}
+
+// startServer runs the HTTP server and, unless MQTTPort is 0, the MQTT
+// broker until SIGINT or SIGTERM and shuts both down gracefully.
 func startServer() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	config := iotedge.GetConfig()
 	iot := iotedge.New(config)
-	go iotedge.StartMQTTBroker(config.MQTTPort, config)
-	return iot.StartSensorServer(nil)
+
+	brokerErr := make(chan error, 1)
+	if config.MQTTPort > 0 {
+		broker := iotedge.NewMQTTEdge(config.MQTTPort, config)
+		go func() {
+			brokerErr <- broker.Start(ctx)
+		}()
+	} else {
+		go func() {
+			<-ctx.Done()
+			brokerErr <- nil
+		}()
+	}
+	httpStop := make(chan bool)
+	httpErr := make(chan error, 1)
+	go func() {
+		httpErr <- iot.StartSensorServer(httpStop)
+	}()
+
+	select {
+	case <-ctx.Done():
+		fmt.Println("Shutting down...")
+	case err := <-brokerErr:
+		log.Errorf("MQTT broker stopped: %v", err)
+		httpStop <- true
+		<-httpErr
+		return err
+	case err := <-httpErr:
+		stop()
+		<-brokerErr
+		return err
+	}
+	httpStop <- true
+	err := <-httpErr
+	if mqttErr := <-brokerErr; mqttErr != nil {
+		return mqttErr
+	}
+	return err
 }
@@ -0,0 +1,278 @@
+package iotedge
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TimeFormatUnix   string = "unix"   // seconds since 1970
+	TimeFormatUnixMS string = "unixms" // milliseconds since 1970
+)
+
+// importBatchValues is the number of values collected before they're
+// written, so large files are never kept in memory.
+const importBatchValues = 5000
+
+// CSVImportOptions describe the layout of a CSV file. The first line has
+// to be a header.
+type CSVImportOptions struct {
+	Delimiter  rune   // defaults to ','
+	TimeColumn string // header of the timestamp column, defaults to the first column
+	// TimeFormat is a Go layout like "02.01.2006 15:04", TimeFormatUnix or
+	// TimeFormatUnixMS. Empty accepts RFC3339 and "2006-01-02 15:04:05"
+	// with optional milliseconds.
+	TimeFormat string
+	Location   *time.Location // of timestamps without zone, defaults to UTC
+	// Columns maps value columns to tags. Empty imports all other columns
+	// with TagPrefix and the header as tag.
+	Columns   map[string]string
+	TagPrefix string
+	// Replace overwrites existing values, otherwise values whose tag and
+	// timestamp already exist are skipped.
+	Replace  bool
+	DryRun   bool
+	Progress func(CSVImportStats)
+}
+
+type CSVImportStats struct {
+	Lines   int            // data lines read
+	Values  int            // values read
+	Written int            // values inserted or replaced
+	Empty   int            // empty cells
+	Invalid int            // cells that aren't numbers
+	Tags    map[string]int // values per tag
+	First   time.Time
+	Last    time.Time
+}
+
+// Duplicates are the values that were skipped because they were stored
+// already or repeated in the file.
+func (s CSVImportStats) Duplicates() int {
+	return s.Values - s.Written
+}
+
+// pendingTag collects the values of a tag until they're written. A
+// timestamp is only kept once per batch, postgres refuses to update the same
+// row twice in one statement.
+type pendingTag struct {
+	data  timeseries.TimeseriesImportStruct
+	index map[string]int
+}
+
+type csvColumn struct {
+	index int
+	tag   string
+}
+
+// ImportCSV reads timeseries from a CSV file and writes them to table with
+// InsertTimeseriesBatch. Values are stored as they are, without sensor
+// offsets. An unparsable timestamp stops the import, values written until
+// then are kept.
+func (devDB *DeviceDB) ImportCSV(r io.Reader, table string, opts CSVImportOptions) (CSVImportStats, error) {
+	logFields := log.Fields{"fnct": "ImportCSV", "table": table, "dryRun": opts.DryRun}
+	stats := CSVImportStats{Tags: map[string]int{}}
+	reader := csv.NewReader(r)
+	if opts.Delimiter != 0 {
+		reader.Comma = opts.Delimiter
+	}
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return stats, fmt.Errorf("failed to read header: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+	timeIndex, columns, err := csvColumns(header, opts)
+	if err != nil {
+		return stats, err
+	}
+
+	pending := map[string]*pendingTag{}
+	pendingValues := 0
+	flush := func() error {
+		if pendingValues == 0 {
+			return nil
+		}
+		if !opts.DryRun {
+			data := make([]timeseries.TimeseriesImportStruct, 0, len(pending))
+			for _, p := range pending {
+				data = append(data, p.data)
+			}
+			written, err := devDB.insertTimeseriesBatch(data, table, opts.Replace)
+			stats.Written += written
+			if err != nil {
+				return err
+			}
+		}
+		clear(pending)
+		pendingValues = 0
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+		return nil
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		line, _ := reader.FieldPos(0)
+		if timeIndex >= len(record) || strings.TrimSpace(record[timeIndex]) == "" {
+			continue
+		}
+		ts, err := parseCSVTime(strings.TrimSpace(record[timeIndex]), opts.TimeFormat, opts.Location)
+		if err != nil {
+			return stats, fmt.Errorf("line %d: %w", line, err)
+		}
+		stats.Lines++
+		if stats.First.IsZero() || ts.Before(stats.First) {
+			stats.First = ts
+		}
+		if ts.After(stats.Last) {
+			stats.Last = ts
+		}
+		timestamp := ts.UTC().Format(TimestampFormat)
+		for _, col := range columns {
+			if col.index >= len(record) || strings.TrimSpace(record[col.index]) == "" {
+				stats.Empty++
+				continue
+			}
+			value, err := parseCSVValue(record[col.index])
+			if err != nil {
+				stats.Invalid++
+				log.WithFields(logFields).Debugf("line %d: %v", line, err)
+				continue
+			}
+			stats.Values++
+			stats.Tags[col.tag]++
+			p, ok := pending[col.tag]
+			if !ok {
+				p = &pendingTag{data: timeseries.TimeseriesImportStruct{Tag: col.tag}, index: map[string]int{}}
+				pending[col.tag] = p
+			}
+			if i, ok := p.index[timestamp]; ok {
+				// without Replace the first value wins, as for stored rows
+				if opts.Replace {
+					p.data.Values[i] = value
+				}
+				continue
+			}
+			p.index[timestamp] = len(p.data.Values)
+			p.data.Timestamps = append(p.data.Timestamps, timestamp)
+			p.data.Values = append(p.data.Values, value)
+			pendingValues++
+		}
+		if pendingValues >= importBatchValues {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return stats, err
+	}
+
+	if opts.Replace && !opts.DryRun && stats.Written > 0 && len(devDB.rollupsOf(table)) > 0 {
+		// replaced values can't be merged into the rollups incrementally
+		if _, err := devDB.BackfillRollups(table, stats.First); err != nil {
+			return stats, err
+		}
+	}
+	log.WithFields(logFields).Infof("Imported %+v", stats)
+	return stats, nil
+}
+
+// csvColumns returns the index of the timestamp column and the value
+// columns with their tags.
+func csvColumns(header []string, opts CSVImportOptions) (int, []csvColumn, error) {
+	timeIndex := 0
+	if opts.TimeColumn != "" {
+		timeIndex = slices.Index(header, opts.TimeColumn)
+		if timeIndex < 0 {
+			return 0, nil, fmt.Errorf("no column '%s' in header %v", opts.TimeColumn, header)
+		}
+	}
+	var columns []csvColumn
+	if len(opts.Columns) == 0 {
+		for i, name := range header {
+			if i != timeIndex && name != "" {
+				columns = append(columns, csvColumn{index: i, tag: opts.TagPrefix + name})
+			}
+		}
+	}
+	for name, tag := range opts.Columns {
+		i := slices.Index(header, name)
+		if i < 0 {
+			return 0, nil, fmt.Errorf("no column '%s' in header %v", name, header)
+		}
+		columns = append(columns, csvColumn{index: i, tag: tag})
+	}
+	if len(columns) == 0 {
+		return 0, nil, fmt.Errorf("no value columns in header %v", header)
+	}
+	slices.SortFunc(columns, func(a, b csvColumn) int { return a.index - b.index })
+	return timeIndex, columns, nil
+}
+
+// csvTimeLayouts are tried without TimeFormat before RFC3339.
+var csvTimeLayouts = []string{TimestampFormat, time.DateTime, "2006-01-02T15:04:05", "2006-01-02 15:04"}
+
+func parseCSVTime(s string, format string, loc *time.Location) (time.Time, error) {
+	switch format {
+	case "":
+		for _, layout := range csvTimeLayouts {
+			if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+				return t, nil
+			}
+		}
+		return ParseTimestamp(s)
+	case TimeFormatUnix, TimeFormatUnixMS:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid unix time '%s'", s)
+		}
+		if format == TimeFormatUnixMS {
+			return time.UnixMilli(int64(n)), nil
+		}
+		return time.UnixMilli(int64(n * 1000)), nil
+	}
+	t, err := time.ParseInLocation(format, s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp '%s' for format '%s'", s, format)
+	}
+	return t, nil
+}
+
+// parseCSVValue accepts a decimal comma as spreadsheets in many locales
+// write it.
+func parseCSVValue(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, ".") {
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid value '%s'", s)
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64), nil
+}
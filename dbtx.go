@@ -0,0 +1,129 @@
+package iotedge
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "github.com/lib/pq"
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+	"modernc.org/sqlite"
+)
+
+// DbHandler runs every statement on its own pooled connection. Statements
+// that have to be applied together run in a transaction on a second pool
+// opened with the same config.
+var txMutex sync.Mutex
+var txDBs = map[string]*sql.DB{}
+
+// txSSLMode is the sslmode of the postgres pool, set by New from DBSSLMode.
+var txSSLMode = "disable"
+
+// sqliteBusyTimeout is how long a sqlite connection waits for the lock held
+// by another connection, e.g. by a batch transaction, instead of failing.
+const sqliteBusyTimeout = 5000 // in milliseconds
+
+func init() {
+	// applies to every sqlite connection of the process, also to the pool of
+	// the timeseries library
+	sqlite.RegisterConnectionHook(func(conn sqlite.ExecQuerierContext, dsn string) error {
+		_, err := conn.ExecContext(context.Background(), fmt.Sprintf("PRAGMA busy_timeout = %d", sqliteBusyTimeout), nil)
+		return err
+	})
+}
+
+func setTxSSLMode(mode string) {
+	txMutex.Lock()
+	defer txMutex.Unlock()
+	if mode != "" {
+		txSSLMode = mode
+	}
+}
+
+func openTxDB(config timeseries.DBConfig) (*sql.DB, error) {
+	txMutex.Lock()
+	defer txMutex.Unlock()
+	driver := "sqlite"
+	// take the lock on BEGIN so two transactions can't deadlock
+	dsn := filepath.Join(config.IPOrPath, config.Name) + "?_txlock=immediate"
+	if config.UsePostgres {
+		driver = "postgres"
+		dsn = (&url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(config.User, config.Password),
+			Host:     net.JoinHostPort(config.IPOrPath, strconv.Itoa(config.Port)),
+			Path:     "/" + config.Name,
+			RawQuery: url.Values{"sslmode": {txSSLMode}}.Encode(),
+		}).String()
+	}
+	if db, ok := txDBs[dsn]; ok {
+		return db, nil
+	}
+	log.WithFields(log.Fields{"fnct": "openTxDB", "name": config.Name}).Infoln("open")
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if !config.UsePostgres {
+		// sqlite allows a single writer anyway
+		db.SetMaxOpenConns(1)
+	}
+	txDBs[dsn] = db
+	return db, nil
+}
+
+// dbTx is a transaction with the placeholder handling of ExecuteQuery.
+type dbTx struct {
+	*sql.Tx
+	usePostgres bool
+}
+
+func beginTx(config timeseries.DBConfig) (*dbTx, error) {
+	db, err := openTxDB(config)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{Tx: tx, usePostgres: config.UsePostgres}, nil
+}
+
+func (tx *dbTx) ExecuteQuery(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Query(tx.rebind(query), args...)
+}
+
+func (tx *dbTx) execAll(statements []string) error {
+	for _, sqlStr := range statements {
+		if _, err := tx.Exec(tx.rebind(sqlStr)); err != nil {
+			return fmt.Errorf("'%s' failed: %v", sqlStr, err)
+		}
+	}
+	return nil
+}
+
+// rebind replaces the ? placeholders by $1, $2, ... on postgres.
+func (tx *dbTx) rebind(query string) string {
+	if !tx.usePostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, ch := range query {
+		if ch == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
@@ -1,7 +1,10 @@
 package iotedge
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,7 +14,49 @@ import (
 
 type DeviceDB struct {
 	*timeseries.DbHandler
-	conf timeseries.DBConfig
+	conf        timeseries.DBConfig
+	sensorCache *sensorCache
+	heartbeats  *heartbeats
+	configHook  *configHook
+	rollups     *rollupRegistry
+}
+
+// deviceColumns matches the field order expected by scanDevice.
+const deviceColumns = "id, name, description, intervall, buffer, last_seen, config_version, config_applied"
+
+var (
+	ErrDeviceNotFound = errors.New("device not found")
+	ErrSensorNotFound = errors.New("sensor not found")
+	// ErrSensorOfOtherDevice is returned for sensor names registered by
+	// another device, the name is the stored tag and has a single owner.
+	ErrSensorOfOtherDevice = errors.New("sensor belongs to another device")
+)
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDevice(rows rowScanner, dev *Device) error {
+	var lastSeen dbTime
+	if err := rows.Scan(&dev.ID, &dev.Name, &dev.Description, &dev.Interval, &dev.Buffer, &lastSeen,
+		&dev.ConfigVersion, &dev.AppliedConfigVersion); err != nil {
+		return err
+	}
+	dev.LastSeen = nil
+	if !lastSeen.IsZero() {
+		dev.LastSeen = &lastSeen.Time
+	}
+	return nil
+}
+
+// sensorCacheTTL bounds how long sensor offsets changed by another process
+// can go unnoticed.
+const sensorCacheTTL = time.Minute
+
+type sensorCache struct {
+	mutex    sync.Mutex
+	sensors  map[string]Sensor
+	loadedAt time.Time
 }
 
 var onceDeviceDB sync.Once
@@ -33,17 +78,16 @@ func GetDeviceDB(config timeseries.DBConfig) *DeviceDB {
 	}
 	onceDeviceDB.Do(func() {
 		logger.Infoln("init")
-		deviceDB = &DeviceDB{conf: config}
-		deviceDB.DbHandler = dbhandler
-		var idStr, numericType string
-		if config.UsePostgres {
-			// Define type strings based on database type
-			idStr = "id SERIAL PRIMARY KEY"
-			numericType = "NUMERIC"
-		} else {
-			idStr = "id INTEGER PRIMARY KEY AUTOINCREMENT"
-			numericType = "NUMBER"
+		deviceDB = &DeviceDB{
+			conf:        config,
+			sensorCache: &sensorCache{},
+			heartbeats:  &heartbeats{written: make(map[int]time.Time)},
+			configHook:  &configHook{},
+			rollups:     &rollupRegistry{},
 		}
+		deviceDB.DbHandler = dbhandler
+		idStr := deviceDB.idColumn()
+		numericType := deviceDB.numericType()
 
 		sqlStr := `CREATE TABLE IF NOT EXISTS devices (
 			` + idStr + ` ,
@@ -67,6 +111,26 @@ func GetDeviceDB(config timeseries.DBConfig) *DeviceDB {
 		if _, err := deviceDB.ExecuteQuery(sqlStr); err != nil {
 			logger.Fatalf("failed to create sensors table:%v", err)
 		}
+		if err := deviceDB.createSensorNameIndex(); err != nil {
+			logger.Fatalf("failed to create sensor name index:%v", err)
+		}
+		if err := deviceDB.addColumnIfMissing("devices", "last_seen", deviceDB.timestampType()); err != nil {
+			logger.Fatalf("failed to add last_seen to devices table:%v", err)
+		}
+		if err := deviceDB.addColumnIfMissing("devices", "mqtt_password", "TEXT"); err != nil {
+			logger.Fatalf("failed to add mqtt_password to devices table:%v", err)
+		}
+		for _, column := range []string{"config_version", "config_applied"} {
+			if err := deviceDB.addColumnIfMissing("devices", column, "INTEGER DEFAULT 0"); err != nil {
+				logger.Fatalf("failed to add %s to devices table:%v", column, err)
+			}
+		}
+		if err := deviceDB.createTokenTables(); err != nil {
+			logger.Fatalf("failed to create token tables:%v", err)
+		}
+		if err := deviceDB.createDeadLetterTable(); err != nil {
+			logger.Fatalf("failed to create dead letter table:%v", err)
+		}
 	})
 	if !compareConfigs(deviceDB.conf, config) {
 		logger.Fatalf("Config must not change %+v to %+v", deviceDB.conf, config)
@@ -76,6 +140,27 @@ func GetDeviceDB(config timeseries.DBConfig) *DeviceDB {
 	return deviceDB
 }
 
+func (devDB *DeviceDB) idColumn() string {
+	if devDB.conf.UsePostgres {
+		return "id SERIAL PRIMARY KEY"
+	}
+	return "id INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+func (devDB *DeviceDB) numericType() string {
+	if devDB.conf.UsePostgres {
+		return "NUMERIC"
+	}
+	return "NUMBER"
+}
+
+func (devDB *DeviceDB) timestampType() string {
+	if devDB.conf.UsePostgres {
+		return "TIMESTAMP"
+	}
+	return "DATETIME"
+}
+
 func compareConfigs(oldConf, newConf timeseries.DBConfig) bool {
 	if oldConf.Name != newConf.Name {
 		return false
@@ -103,7 +188,7 @@ func (devDB *DeviceDB) GetOrCreateDevice(descr DeviceDesc) (Device, error) {
 	logFields := log.Fields{"fnct": "GetOrCreateDevice", "device": descr.Name}
 	log.WithFields(logFields).Infoln("Look for device")
 	startTime := time.Now()
-	deviceRows, err := devDB.ExecuteQuery("SELECT * FROM devices WHERE name = ?", descr.Name)
+	deviceRows, err := devDB.ExecuteQuery("SELECT "+deviceColumns+" FROM devices WHERE name = ?", descr.Name)
 	if err != nil {
 		return Device{}, err
 	}
@@ -112,7 +197,7 @@ func (devDB *DeviceDB) GetOrCreateDevice(descr DeviceDesc) (Device, error) {
 	hasDevice := deviceRows.Next() // is unique
 	if hasDevice {
 		log.WithFields(logFields).Infoln("Device already initialized")
-		if err := deviceRows.Scan(&dev.ID, &dev.Name, &dev.Description, &dev.Buffer, &dev.Interval); err != nil {
+		if err := scanDevice(deviceRows, &dev); err != nil {
 			return Device{}, err
 		}
 		if err = deviceRows.Err(); err != nil {
@@ -129,13 +214,13 @@ func (devDB *DeviceDB) GetOrCreateDevice(descr DeviceDesc) (Device, error) {
 		log.WithFields(logFields).Errorf("Insert device failed: %v", err)
 		return dev, err
 	}
-	rows, err := devDB.ExecuteQuery("SELECT * FROM devices WHERE name = ?", descr.Name)
+	rows, err := devDB.ExecuteQuery("SELECT "+deviceColumns+" FROM devices WHERE name = ?", descr.Name)
 	if err != nil {
 		log.WithFields(logFields).Errorf("Reading device after inserting failed: %v", err)
 		return dev, err
 	}
 	for rows.Next() {
-		if err := rows.Scan(&dev.ID, &dev.Name, &dev.Description, &dev.Buffer, &dev.Interval); err != nil {
+		if err := scanDevice(rows, &dev); err != nil {
 			log.WithFields(logFields).Errorf("Scan failed: %v", err)
 			return dev, err
 		}
@@ -153,26 +238,67 @@ func (devDB *DeviceDB) GetDevice(name string) (Device, error) {
 	logFields := log.Fields{"fnct": "GetDevice", "name": name}
 	log.WithFields(logFields).Infof("Find device with name %v", name)
 
-	rows, err := devDB.ExecuteQuery("SELECT * FROM devices WHERE name = ?", name)
+	rows, err := devDB.ExecuteQuery("SELECT "+deviceColumns+" FROM devices WHERE name = ?", name)
 	if err != nil {
 		return Device{}, err
 	}
 	defer rows.Close()
 
 	var dev Device
-	for rows.Next() {
-		err := rows.Scan(&dev.ID, &dev.Name, &dev.Description, &dev.Buffer, &dev.Interval)
-		if err != nil {
+	if rows.Next() { // is unique
+		if err := scanDevice(rows, &dev); err != nil {
 			log.WithFields(logFields).Errorf("Failed to scan device %v", err)
 			return Device{}, fmt.Errorf("failed to scan device %v", err)
 		}
 		log.WithFields(logFields).Infof("Device found %+v", dev)
+		return dev, nil
 	}
 	if err = rows.Err(); err != nil {
 		return Device{}, err
 	}
 	log.WithFields(logFields).Errorf("Device '%s' not found", name)
-	return dev, err
+	return dev, ErrDeviceNotFound
+}
+
+func (devDB *DeviceDB) GetDevices() ([]Device, error) {
+	logFields := log.Fields{"fnct": "GetDevices"}
+	log.WithFields(logFields).Infoln("Get all devices")
+
+	rows, err := devDB.ExecuteQuery("SELECT " + deviceColumns + " FROM devices ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var dev Device
+		if err := scanDevice(rows, &dev); err != nil {
+			log.WithFields(logFields).Errorf("Failed to scan device %v", err)
+			return nil, fmt.Errorf("failed to scan device %v", err)
+		}
+		devices = append(devices, dev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// DeleteDevice removes the device together with its sensors.
+func (devDB *DeviceDB) DeleteDevice(dev Device) error {
+	logFields := log.Fields{"fnct": "DeleteDevice", "device": dev.Name}
+	log.WithFields(logFields).Infof("Delete device %d", dev.ID)
+	if _, err := devDB.ExecuteQuery("DELETE FROM sensors WHERE deviceid = ?", dev.ID); err != nil {
+		log.WithFields(logFields).Errorf("deleting sensors failed: %v", err)
+		return err
+	}
+	if _, err := devDB.ExecuteQuery("DELETE FROM devices WHERE id = ?", dev.ID); err != nil {
+		log.WithFields(logFields).Errorf("deleting device failed: %v", err)
+		return err
+	}
+	devDB.InvalidateSensorCache()
+	return nil
 }
 
 func (devDB *DeviceDB) GetSensors(deviceID int) ([]Sensor, error) {
@@ -198,16 +324,46 @@ func (devDB *DeviceDB) GetSensors(deviceID int) ([]Sensor, error) {
 	return sensors, err
 }
 
+func (devDB *DeviceDB) GetSensor(deviceID int, name string) (Sensor, error) {
+	sensors, err := devDB.GetSensors(deviceID)
+	if err != nil {
+		return Sensor{}, err
+	}
+	for _, sensor := range sensors {
+		if sensor.Name == name {
+			return sensor, nil
+		}
+	}
+	return Sensor{}, ErrSensorNotFound
+}
+
+func (devDB *DeviceDB) DeleteSensor(sensor Sensor) error {
+	logFields := log.Fields{"fnct": "DeleteSensor", "sensor": sensor.Name}
+	log.WithFields(logFields).Infof("Delete sensor %d", sensor.ID)
+	if _, err := devDB.ExecuteQuery("DELETE FROM sensors WHERE id = ?", sensor.ID); err != nil {
+		log.WithFields(logFields).Errorf("exec failed: %v", err)
+		return err
+	}
+	devDB.InvalidateSensorCache()
+	if _, err := devDB.ExecuteQuery("UPDATE devices SET config_version = config_version + 1 WHERE id = ?", sensor.DeviceID); err != nil {
+		log.WithFields(logFields).Errorf("exec failed: %v", err)
+		return err
+	}
+	devDB.configChanged(sensor.DeviceID)
+	return nil
+}
+
 func (devDB *DeviceDB) Configure(dev Device) error {
 	logFields := log.Fields{"fnct": "Configure", "device": dev.Name}
 	log.WithFields(logFields).Infof("Configure device '%s' with interval/buffer: %v/%v ",
 		dev.Name, dev.Interval, dev.Buffer)
-	_, err := devDB.ExecuteQuery("UPDATE devices SET description = ? , buffer = ? , intervall = ? WHERE id = ?", dev.Description, dev.Buffer, dev.Interval, dev.ID)
+	_, err := devDB.ExecuteQuery("UPDATE devices SET description = ? , buffer = ? , intervall = ? , config_version = config_version + 1 WHERE id = ?", dev.Description, dev.Buffer, dev.Interval, dev.ID)
 	if err != nil {
 		log.WithFields(logFields).Errorf("exec failed: %v)", err)
 		return err
 	}
 	log.WithFields(logFields).Infof("Succefully updated device %v", dev.Name)
+	devDB.configChanged(dev.ID)
 	return nil
 }
 
@@ -215,13 +371,19 @@ func (devDB *DeviceDB) ConfigureSensor(sensor Sensor) error {
 	logFields := log.Fields{"fnct": "ConfigureSensor"}
 	log.WithFields(logFields).Infof("Configure sensor %s with offset: %v ",
 		sensor.Name, sensor.SensorOffset)
-	_, err := devDB.ExecuteQuery("UPDATE sensors SET name = ? , sensor_offset = ?  WHERE deviceid = ?",
-		sensor.Name, sensor.SensorOffset, sensor.DeviceID)
+	_, err := devDB.ExecuteQuery("UPDATE sensors SET sensor_offset = ? WHERE deviceid = ? AND name = ?",
+		sensor.SensorOffset, sensor.DeviceID, sensor.Name)
 	if err != nil {
 		log.WithFields(logFields).Errorf("exec failed: %v", err)
 		return err
 	}
+	devDB.InvalidateSensorCache()
+	if _, err := devDB.ExecuteQuery("UPDATE devices SET config_version = config_version + 1 WHERE id = ?", sensor.DeviceID); err != nil {
+		log.WithFields(logFields).Errorf("exec failed: %v", err)
+		return err
+	}
 	log.WithFields(logFields).Infof("Succefully updated sensor %s", sensor.Name)
+	devDB.configChanged(sensor.DeviceID)
 	return nil
 
 }
@@ -238,6 +400,45 @@ func (devDB *DeviceDB) insertDevice(device Device) error {
 	return nil
 }
 
+// createSensorNameIndex makes sure a sensor name, which is the stored tag,
+// belongs to a single device.
+func (devDB *DeviceDB) createSensorNameIndex() error {
+	rows, err := devDB.ExecuteQuery("SELECT name FROM sensors GROUP BY name HAVING COUNT(*) > 1 ORDER BY name")
+	if err != nil {
+		return err
+	}
+	var duplicates []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		duplicates = append(duplicates, name)
+	}
+	rows.Close()
+	if len(duplicates) > 0 {
+		return fmt.Errorf("sensors %s are registered by several devices, delete all but one", strings.Join(duplicates, ", "))
+	}
+	_, err = devDB.ExecuteQuery("CREATE UNIQUE INDEX IF NOT EXISTS sensors_name ON sensors (name)")
+	return err
+}
+
+// sensorOwner returns the id of the device that registered the sensor name.
+func (devDB *DeviceDB) sensorOwner(name string) (int, bool, error) {
+	rows, err := devDB.ExecuteQuery("SELECT deviceid FROM sensors WHERE name = ?", name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, false, rows.Err()
+	}
+	var deviceID int
+	err = rows.Scan(&deviceID)
+	return deviceID, err == nil, err
+}
+
 func (devDB *DeviceDB) InsertSensor(sensor Sensor) error {
 	logFields := log.Fields{"fnct": "insertSensor", "sensor": sensor.Name}
 	log.WithFields(logFields).Infof("%s", sensor.Name)
@@ -246,5 +447,106 @@ func (devDB *DeviceDB) InsertSensor(sensor Sensor) error {
 		log.WithFields(logFields).Error(err)
 		return err
 	}
+	devDB.InvalidateSensorCache()
 	return err
 }
+
+// InvalidateSensorCache forces the next sensor lookup to reload all sensors.
+func (devDB *DeviceDB) InvalidateSensorCache() {
+	devDB.sensorCache.mutex.Lock()
+	defer devDB.sensorCache.mutex.Unlock()
+	devDB.sensorCache.sensors = nil
+}
+
+// GetSensorByTag resolves a timeseries tag to its sensor row. Sensors are
+// cached so the ingest paths don't query the sensors table per value.
+func (devDB *DeviceDB) GetSensorByTag(tag string) (Sensor, bool, error) {
+	cache := devDB.sensorCache
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.sensors == nil || time.Since(cache.loadedAt) > sensorCacheTTL {
+		sensors, err := devDB.getAllSensors()
+		if err != nil {
+			return Sensor{}, false, err
+		}
+		cache.sensors = sensors
+		cache.loadedAt = time.Now()
+	}
+	sensor, ok := cache.sensors[tag]
+	return sensor, ok, nil
+}
+
+// SensorOfDevice tells whether the tag is a sensor registered by the device.
+func (devDB *DeviceDB) SensorOfDevice(tag string, deviceID int) (bool, error) {
+	sensor, ok, err := devDB.GetSensorByTag(tag)
+	if err != nil || !ok {
+		return false, err
+	}
+	return sensor.DeviceID == deviceID, nil
+}
+
+func (devDB *DeviceDB) getAllSensors() (map[string]Sensor, error) {
+	logFields := log.Fields{"fnct": "getAllSensors"}
+	log.WithFields(logFields).Infoln("Load sensors")
+	rows, err := devDB.ExecuteQuery("SELECT id, deviceid, name, sensor_offset FROM sensors")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sensors := make(map[string]Sensor)
+	for rows.Next() {
+		var sensor Sensor
+		if err := rows.Scan(&sensor.ID, &sensor.DeviceID, &sensor.Name, &sensor.SensorOffset); err != nil {
+			return nil, err
+		}
+		// the unique index prevents this, a tag must not resolve to
+		// whichever device was read last
+		if other, ok := sensors[sensor.Name]; ok && other.DeviceID != sensor.DeviceID {
+			return nil, fmt.Errorf("sensor %s: %w", sensor.Name, ErrSensorOfOtherDevice)
+		}
+		sensors[sensor.Name] = sensor
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sensors, nil
+}
+
+// ApplySensorOffset adds the configured offset of the tag's sensor to all
+// values. The raw value is kept in the comment as "raw=<value>" so the
+// calibration can be changed and re-applied later.
+func (devDB *DeviceDB) ApplySensorOffset(ts timeseries.TimeseriesImportStruct) timeseries.TimeseriesImportStruct {
+	logFields := log.Fields{"fnct": "ApplySensorOffset", "tag": ts.Tag}
+	sensor, ok, err := devDB.GetSensorByTag(ts.Tag)
+	if err != nil {
+		log.WithFields(logFields).Errorf("sensor lookup failed: %v", err)
+		return ts
+	}
+	if !ok || sensor.SensorOffset == 0 {
+		return ts
+	}
+	log.WithFields(logFields).Tracef("Apply offset %v", sensor.SensorOffset)
+	// the offset as configured, float64(0.1f) would add 0.10000000149...
+	offset, _ := strconv.ParseFloat(strconv.FormatFloat(float64(sensor.SensorOffset), 'g', -1, 32), 64)
+	values := make([]string, len(ts.Values))
+	comments := make([]string, max(len(ts.Values), len(ts.Comments)))
+	copy(comments, ts.Comments)
+	for i, val := range ts.Values {
+		raw, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			log.WithFields(logFields).Warnf("Not a valid number: %v", val)
+			values[i] = val
+			continue
+		}
+		values[i] = strconv.FormatFloat(raw+offset, 'f', -1, 64)
+		rawComment := RawValueCommentPrefix + val
+		if comments[i] == "" {
+			comments[i] = rawComment
+		} else {
+			comments[i] = comments[i] + ";" + rawComment
+		}
+	}
+	ts.Values = values
+	ts.Comments = comments
+	return ts
+}
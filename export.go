@@ -0,0 +1,205 @@
+package iotedge
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ExportCSV        string = "csv"
+	ExportJSONLines  string = "jsonl"
+	ExportTimeseries string = "timeseries" // the format /timeseries/save accepts
+)
+
+// OffsetsApplied as "offsets" parameter of /timeseries/save stores the values
+// as they are. Exported values carry the sensor offsets already, they must
+// not be applied a second time when the export is imported.
+const OffsetsApplied = "applied"
+
+// exportChunk limits the values per exported TimeseriesImportStruct, so long
+// ranges of a tag are split into several objects instead of being collected
+// in memory.
+const exportChunk = 1000
+
+// exportFlushRows is the number of rows after which the output is flushed
+// so HTTP clients receive the data while it is read.
+const exportFlushRows = 500
+
+// timeseriesExporter writes the rows of one format.
+type timeseriesExporter interface {
+	begin() error
+	add(row TimeseriesRow) error
+	end() error
+}
+
+func newTimeseriesExporter(w *bufio.Writer, format string) (timeseriesExporter, error) {
+	switch format {
+	case ExportCSV:
+		return &csvExporter{w: csv.NewWriter(w)}, nil
+	case ExportJSONLines:
+		return &jsonLinesExporter{enc: json.NewEncoder(w)}, nil
+	case ExportTimeseries:
+		return &timeseriesImportExporter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown export format '%s'", format)
+}
+
+func ExportContentType(format string) string {
+	switch format {
+	case ExportCSV:
+		return "text/csv; charset=utf-8"
+	case ExportJSONLines:
+		return "application/x-ndjson"
+	}
+	return "application/json; charset=utf-8"
+}
+
+func ExportFileExtension(format string) string {
+	if format == ExportTimeseries {
+		return "json"
+	}
+	return format
+}
+
+// ExportTimeseries streams the raw rows of the tags within [Start, End) to w
+// and returns the number of rows written. Nothing is written if the query
+// fails.
+func (devDB *DeviceDB) ExportTimeseries(w io.Writer, table string, q TimeseriesQuery, format string) (int, error) {
+	logFields := log.Fields{"fnct": "ExportTimeseries", "tags": q.Tags, "format": format}
+	if len(q.Tags) == 0 {
+		return 0, fmt.Errorf("no tag given")
+	}
+	buf := bufio.NewWriter(w)
+	exporter, err := newTimeseriesExporter(buf, format)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := devDB.timeseriesRows(table, q)
+	if err != nil {
+		log.WithFields(logFields).Errorf("query failed: %v", err)
+		return 0, err
+	}
+	defer rows.Close()
+
+	if err := exporter.begin(); err != nil {
+		return 0, err
+	}
+	count := 0
+	for rows.Next() {
+		row, err := scanTimeseriesRow(rows)
+		if err != nil {
+			return count, err
+		}
+		if err := exporter.add(row); err != nil {
+			return count, err
+		}
+		count++
+		if count%exportFlushRows == 0 {
+			if err := buf.Flush(); err != nil {
+				return count, err
+			}
+			if f, ok := w.(interface{ Flush() }); ok {
+				f.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	if err := exporter.end(); err != nil {
+		return count, err
+	}
+	log.WithFields(logFields).Infof("Exported %d rows", count)
+	return count, buf.Flush()
+}
+
+func formatExportValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) begin() error {
+	return e.w.Write([]string{"time", "tag", "value", "comment"})
+}
+
+func (e *csvExporter) add(row TimeseriesRow) error {
+	return e.w.Write([]string{row.Time.Format(time.RFC3339Nano), row.Tag, formatExportValue(row.Value), row.Comment})
+}
+
+func (e *csvExporter) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonLinesExporter struct {
+	enc *json.Encoder
+}
+
+func (e *jsonLinesExporter) begin() error { return nil }
+
+func (e *jsonLinesExporter) add(row TimeseriesRow) error {
+	return e.enc.Encode(row)
+}
+
+func (e *jsonLinesExporter) end() error { return nil }
+
+// timeseriesImportExporter writes a JSON array of TimeseriesImportStruct,
+// each holding up to exportChunk values of one tag.
+type timeseriesImportExporter struct {
+	w       *bufio.Writer
+	current timeseries.TimeseriesImportStruct
+	written bool
+}
+
+func (e *timeseriesImportExporter) begin() error {
+	_, err := e.w.WriteString("[")
+	return err
+}
+
+func (e *timeseriesImportExporter) add(row TimeseriesRow) error {
+	if len(e.current.Values) > 0 && (row.Tag != e.current.Tag || len(e.current.Values) >= exportChunk) {
+		if err := e.writeCurrent(); err != nil {
+			return err
+		}
+	}
+	e.current.Tag = row.Tag
+	e.current.Timestamps = append(e.current.Timestamps, row.Time.Format(TimestampFormat))
+	e.current.Values = append(e.current.Values, formatExportValue(row.Value))
+	e.current.Comments = append(e.current.Comments, row.Comment)
+	return nil
+}
+
+func (e *timeseriesImportExporter) writeCurrent() error {
+	data, err := json.Marshal(e.current)
+	if err != nil {
+		return err
+	}
+	if e.written {
+		e.w.WriteString(",\n")
+	}
+	e.written = true
+	e.current = timeseries.TimeseriesImportStruct{}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *timeseriesImportExporter) end() error {
+	if len(e.current.Values) > 0 {
+		if err := e.writeCurrent(); err != nil {
+			return err
+		}
+	}
+	_, err := e.w.WriteString("]\n")
+	return err
+}
@@ -0,0 +1,256 @@
+package iotedge
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRejectedAttempts is how often a batch the upstream refuses as invalid
+// is sent before it is moved aside as dead.
+const maxRejectedAttempts = 5
+
+// ForwardQueue spools batches for the upstream server in a local SQLite file
+// and retries them until the upstream accepted them. Batches the upstream
+// keeps refusing with a client error are marked dead and kept in the file.
+type ForwardQueue struct {
+	db         *sql.DB
+	url        string
+	token      string
+	maxBytes   int64
+	wake       chan struct{}
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	sent       atomic.Uint64
+	failed     atomic.Uint64
+	dropped    atomic.Uint64
+}
+
+type ForwardQueueStats struct {
+	Depth   int // batches waiting to be sent
+	Bytes   int64
+	Dead    int // batches the upstream refused
+	Sent    uint64
+	Failed  uint64
+	Dropped uint64
+}
+
+// forwardError is the answer of the upstream to a refused batch.
+type forwardError struct {
+	status string
+	code   int
+}
+
+func (e *forwardError) Error() string {
+	return "failed with status: " + e.status
+}
+
+// permanent tells whether sending the batch again can't succeed, timeouts
+// and rate limits are retried.
+func (e *forwardError) permanent() bool {
+	return e.code >= 400 && e.code < 500 &&
+		e.code != http.StatusRequestTimeout && e.code != http.StatusTooManyRequests
+}
+
+func OpenForwardQueue(path string, url string, token string, maxBytes int64) (*ForwardQueue, error) {
+	logger := log.WithFields(log.Fields{"fnct": "OpenForwardQueue", "path": path})
+	logger.Infof("Open queue for %s", url)
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows a single writer anyway
+	db.SetMaxOpenConns(1)
+	sqlStr := `CREATE TABLE IF NOT EXISTS queue (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		created  DATETIME DEFAULT CURRENT_TIMESTAMP,
+		attempts INTEGER DEFAULT 0,
+		payload  BLOB NOT NULL
+	);`
+	if _, err := db.Exec(sqlStr); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create queue table: %v", err)
+	}
+	// queue files of older versions lack the dead column
+	var hasDead bool
+	if err := db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('queue') WHERE name = 'dead'").Scan(&hasDead); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read queue table: %v", err)
+	}
+	if !hasDead {
+		if _, err := db.Exec("ALTER TABLE queue ADD COLUMN dead INTEGER DEFAULT 0"); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to add dead column: %v", err)
+		}
+	}
+	return &ForwardQueue{
+		db:         db,
+		url:        url,
+		token:      token,
+		maxBytes:   maxBytes,
+		wake:       make(chan struct{}, 1),
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+	}, nil
+}
+
+func (q *ForwardQueue) Close() error {
+	return q.db.Close()
+}
+
+// Enqueue stores the batch. If the queue grows beyond its size limit the
+// oldest batches are dropped, a batch larger than the limit is refused.
+func (q *ForwardQueue) Enqueue(data []timeseries.TimeseriesImportStruct) error {
+	logger := log.WithFields(log.Fields{"fnct": "Enqueue"})
+	if len(data) == 0 {
+		return nil
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if q.maxBytes > 0 && int64(len(jsonData)) > q.maxBytes {
+		q.dropped.Add(1)
+		return fmt.Errorf("batch of %d bytes exceeds the queue size of %d bytes", len(jsonData), q.maxBytes)
+	}
+	if _, err := q.db.Exec("INSERT INTO queue (payload) VALUES (?)", jsonData); err != nil {
+		logger.Errorf("failed to queue batch: %v", err)
+		return err
+	}
+	if err := q.enforceLimit(); err != nil {
+		logger.Errorf("failed to limit queue: %v", err)
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *ForwardQueue) enforceLimit() error {
+	if q.maxBytes <= 0 {
+		return nil
+	}
+	var total int64
+	if err := q.db.QueryRow("SELECT COALESCE(SUM(LENGTH(payload)), 0) FROM queue").Scan(&total); err != nil {
+		return err
+	}
+	for total > q.maxBytes {
+		var id, size int64
+		err := q.db.QueryRow("SELECT id, LENGTH(payload) FROM queue ORDER BY id LIMIT 1").Scan(&id, &size)
+		if err != nil {
+			return err
+		}
+		if _, err := q.db.Exec("DELETE FROM queue WHERE id = ?", id); err != nil {
+			return err
+		}
+		q.dropped.Add(1)
+		log.WithFields(log.Fields{"fnct": "enforceLimit"}).Errorf("Queue full, dropped batch %d (%d bytes)", id, size)
+		total -= size
+	}
+	return nil
+}
+
+func (q *ForwardQueue) Stats() (ForwardQueueStats, error) {
+	stats := ForwardQueueStats{
+		Sent:    q.sent.Load(),
+		Failed:  q.failed.Load(),
+		Dropped: q.dropped.Load(),
+	}
+	err := q.db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN dead = 0 THEN 1 ELSE 0 END), 0), COALESCE(SUM(dead), 0),
+		COALESCE(SUM(LENGTH(payload)), 0) FROM queue`).Scan(&stats.Depth, &stats.Dead, &stats.Bytes)
+	return stats, err
+}
+
+// Run forwards the queued batches oldest first until stop is closed. Failed
+// sends are retried with exponential backoff. A batch refused with a client
+// error maxRejectedAttempts times is marked dead so it doesn't block the
+// batches after it.
+func (q *ForwardQueue) Run(stop <-chan struct{}) {
+	logger := log.WithFields(log.Fields{"fnct": "ForwardQueue.Run"})
+	backoff := q.minBackoff
+	for {
+		var id int64
+		var attempts int
+		var payload []byte
+		err := q.db.QueryRow("SELECT id, attempts, payload FROM queue WHERE dead = 0 ORDER BY id LIMIT 1").
+			Scan(&id, &attempts, &payload)
+		if err == sql.ErrNoRows {
+			select {
+			case <-stop:
+				return
+			case <-q.wake:
+			}
+			continue
+		}
+		if err == nil {
+			err = postTimeseries(payload, q.url, q.token)
+			if err == nil {
+				if _, err := q.db.Exec("DELETE FROM queue WHERE id = ?", id); err != nil {
+					logger.Errorf("failed to remove sent batch: %v", err)
+				}
+				q.sent.Add(1)
+				backoff = q.minBackoff
+				continue
+			}
+			q.failed.Add(1)
+			var refused *forwardError
+			dead := errors.As(err, &refused) && refused.permanent() && attempts+1 >= maxRejectedAttempts
+			if _, err := q.db.Exec("UPDATE queue SET attempts = attempts + 1, dead = ? WHERE id = ?", dead, id); err != nil {
+				logger.Errorf("failed to count attempt: %v", err)
+			}
+			if dead {
+				logger.Errorf("Upstream refused batch %d %d times, marked it dead: %v", id, attempts+1, err)
+				continue
+			}
+		}
+		logger.Warnf("Forwarding batch %d failed, retry in %v: %v", id, backoff, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, q.maxBackoff)
+	}
+}
+
+func postTimeseries(jsonData []byte, url string, token string) error {
+	client := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	req, err := http.NewRequest(http.MethodPost, url+URISaveTimeseries, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Errorf("Failed to send data: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("Failed with status: %s", resp.Status)
+		return &forwardError{status: resp.Status, code: resp.StatusCode}
+	}
+
+	respStr, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+	}
+	log.Info(string(respStr))
+	return nil
+}
@@ -0,0 +1,102 @@
+package iotedge
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HealthOK          string = "ok"
+	HealthFailed      string = "failed"
+	HealthReady       string = "ready"
+	HealthUnavailable string = "unavailable"
+)
+
+// healthCheckTimeout bounds each readiness check so a hanging database
+// doesn't block the probe.
+const healthCheckTimeout = 2 * time.Second
+
+// flushStaleFactor is the number of upload intervals without successful
+// flush after which the server isn't ready anymore.
+const flushStaleFactor = 3
+
+// Health tells that the process is up and serving requests.
+func (s *IoTEdge) Health(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthStatus{Status: HealthOK})
+}
+
+// Ready checks the database, the MQTT broker and, if the broker runs in
+// this process, that buffered data is flushed.
+func (s *IoTEdge) Ready(c *gin.Context) {
+	status := HealthStatus{Status: HealthReady}
+	for _, check := range []HealthCheck{
+		s.checkDatabase(),
+		s.checkBroker(),
+		s.checkFlush(activeBroker.Load(), time.Now()),
+	} {
+		if check.Status != HealthOK {
+			status.Status = HealthUnavailable
+		}
+		status.Checks = append(status.Checks, check)
+	}
+	code := http.StatusOK
+	if status.Status != HealthReady {
+		log.WithFields(log.Fields{"fnct": "Ready"}).Warnf("Not ready: %+v", status.Checks)
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, status)
+}
+
+func healthResult(name string, err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Name: name, Status: HealthFailed, Message: err.Error()}
+	}
+	return HealthCheck{Name: name, Status: HealthOK}
+}
+
+func (s *IoTEdge) checkDatabase() HealthCheck {
+	result := make(chan error, 1)
+	go func() {
+		rows, err := s.DeviceDB.ExecuteQuery("SELECT 1")
+		if err == nil {
+			rows.Close()
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return healthResult("database", err)
+	case <-time.After(healthCheckTimeout):
+		return healthResult("database", fmt.Errorf("no answer within %v", healthCheckTimeout))
+	}
+}
+
+// checkBroker connects to the MQTT port, the broker may run in another
+// process. Without MQTTPort no broker is expected.
+func (s *IoTEdge) checkBroker() HealthCheck {
+	if s.IoTConfig.MQTTPort <= 0 {
+		return HealthCheck{Name: "mqtt", Status: HealthOK, Message: "no broker configured"}
+	}
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", s.IoTConfig.MQTTPort), healthCheckTimeout)
+	if err == nil {
+		conn.Close()
+	}
+	return healthResult("mqtt", err)
+}
+
+func (s *IoTEdge) checkFlush(broker *MQTTEdge, now time.Time) HealthCheck {
+	if broker == nil {
+		return HealthCheck{Name: "flush", Status: HealthOK, Message: "broker not running in this process"}
+	}
+	lastFlush := time.Unix(0, broker.lastFlush.Load())
+	maxAge := flushStaleFactor * time.Duration(s.IoTConfig.UploadInterval) * time.Second
+	if age := now.Sub(lastFlush); age > maxAge {
+		return healthResult("flush", fmt.Errorf("last successful flush %v ago", age.Round(time.Second)))
+	}
+	return HealthCheck{Name: "flush", Status: HealthOK}
+}
@@ -0,0 +1,123 @@
+package iotedge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DeviceStateOnline  string = "online"
+	DeviceStateOffline string = "offline"
+	DeviceStateUnknown string = "unknown"
+)
+
+// lastSeenWriteInterval throttles the last_seen updates so busy devices don't
+// cause a write per value.
+const lastSeenWriteInterval = 10 * time.Second
+
+// offlineFactor is the number of missed uploads after which a device counts
+// as offline.
+const offlineFactor = 2
+
+type heartbeats struct {
+	mutex   sync.Mutex
+	written map[int]time.Time
+}
+
+// addColumnIfMissing extends tables created by older versions.
+func (devDB *DeviceDB) addColumnIfMissing(table string, column string, definition string) error {
+	if devDB.conf.UsePostgres {
+		_, err := devDB.ExecuteQuery("ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS " + column + " " + definition)
+		return err
+	}
+	exists, err := hasColumn(devDB.DbHandler, false, table, column)
+	if err != nil || exists {
+		return err
+	}
+	log.WithFields(log.Fields{"fnct": "addColumnIfMissing", "table": table}).Infof("Add column %s", column)
+	_, err = devDB.ExecuteQuery("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// hasColumn is false for missing tables too.
+func hasColumn(db *timeseries.DbHandler, usePostgres bool, table string, column string) (bool, error) {
+	sqlStr := "SELECT name FROM pragma_table_info('" + table + "') WHERE name = ?"
+	args := []interface{}{column}
+	if usePostgres {
+		sqlStr = "SELECT column_name FROM information_schema.columns WHERE table_name = ? AND column_name = ?"
+		args = []interface{}{table, column}
+	}
+	rows, err := db.ExecuteQuery(sqlStr, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// TouchDevice records that the device has just sent something.
+func (devDB *DeviceDB) TouchDevice(deviceID int) {
+	logFields := log.Fields{"fnct": "TouchDevice", "device": deviceID}
+	now := time.Now().UTC()
+	devDB.heartbeats.mutex.Lock()
+	if now.Sub(devDB.heartbeats.written[deviceID]) < lastSeenWriteInterval {
+		devDB.heartbeats.mutex.Unlock()
+		return
+	}
+	devDB.heartbeats.written[deviceID] = now
+	devDB.heartbeats.mutex.Unlock()
+
+	if _, err := devDB.ExecuteQuery("UPDATE devices SET last_seen = ? WHERE id = ?",
+		now.Format(TimestampFormat), deviceID); err != nil {
+		log.WithFields(logFields).Errorf("updating last_seen failed: %v", err)
+	}
+}
+
+// TouchTag marks the device owning the tag's sensor as seen.
+func (devDB *DeviceDB) TouchTag(tag string) {
+	sensor, ok, err := devDB.GetSensorByTag(tag)
+	if err != nil || !ok {
+		return
+	}
+	devDB.TouchDevice(sensor.DeviceID)
+}
+
+// State derives whether the device is online from its last upload and the
+// configured interval and buffer.
+func (dev Device) State(now time.Time) string {
+	if dev.LastSeen == nil {
+		return DeviceStateUnknown
+	}
+	if now.Sub(*dev.LastSeen) > dev.UploadPeriod()*offlineFactor {
+		return DeviceStateOffline
+	}
+	return DeviceStateOnline
+}
+
+// UploadPeriod is the expected time between two uploads of the device.
+func (dev Device) UploadPeriod() time.Duration {
+	period := time.Duration(float64(dev.Interval) * float64(max(dev.Buffer, 1)) * float64(time.Second))
+	return max(period, lastSeenWriteInterval)
+}
+
+func (devDB *DeviceDB) GetDeviceStatus() ([]DeviceStatus, error) {
+	devices, err := devDB.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	status := []DeviceStatus{}
+	for _, dev := range devices {
+		status = append(status, DeviceStatus{
+			Name:                 dev.Name,
+			LastSeen:             dev.LastSeen,
+			State:                dev.State(now),
+			ConfigVersion:        dev.ConfigVersion,
+			AppliedConfigVersion: dev.AppliedConfigVersion,
+		})
+	}
+	return status, nil
+}
@@ -2,6 +2,7 @@ package iotedge
 
 import (
 	"fmt"
+	"strings"
 
 	_ "modernc.org/sqlite"
 
@@ -9,9 +10,24 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrReservedDeviceName is returned for devices named like the MQTT client
+// of the server, which may use every topic, or like the config topics below
+// "devices/".
+var ErrReservedDeviceName = errors.New("device name is reserved")
+
+func (e *IoTEdge) reservedDeviceName(name string) bool {
+	if e.IoTConfig.MQTTUser != "" && name == e.IoTConfig.MQTTUser {
+		return true
+	}
+	return strings.HasPrefix(name, strings.TrimSuffix(deviceTopicPrefix, "/"))
+}
+
 func (e *IoTEdge) Init(deviceDesc DeviceDesc) (Device, error) {
 	logFields := log.Fields{"fnct": "Init", "Name": deviceDesc.Name, "Desc": deviceDesc.Description}
 	log.WithFields(logFields).Infof("Init %s.", deviceDesc.Name)
+	if e.reservedDeviceName(deviceDesc.Name) {
+		return Device{}, fmt.Errorf("%s: %w", deviceDesc.Name, ErrReservedDeviceName)
+	}
 	dev, err := e.DeviceDB.GetOrCreateDevice(deviceDesc)
 	if err != nil {
 		return Device{}, errors.Wrap(err, "Creating device failed")
@@ -32,12 +48,20 @@ func (e *IoTEdge) Init(deviceDesc DeviceDesc) (Device, error) {
 		}
 		if !hasSensor {
 			log.WithFields(logFields).Infof("Unknown sensor: %s", s)
+			owner, ok, err := e.DeviceDB.sensorOwner(s)
+			if err != nil {
+				return Device{}, fmt.Errorf("failed to get sensor %s: %v", s, err)
+			}
+			if ok && owner != dev.ID {
+				log.WithFields(logFields).Warnf("Sensor %s belongs to device %d", s, owner)
+				return Device{}, fmt.Errorf("sensor %s: %w", s, ErrSensorOfOtherDevice)
+			}
 			sensor := Sensor{
 				Name:     s,
 				DeviceID: dev.ID,
 			}
 			if err := e.DeviceDB.InsertSensor(sensor); err != nil {
-				log.Errorf("Failed to insert sensor %s: %s", sensor.Name, err)
+				return Device{}, fmt.Errorf("failed to insert sensor %s: %v", sensor.Name, err)
 			}
 		}
 	}
@@ -16,9 +16,26 @@ type IoTConfig struct {
 	Port                int
 	MQTTPort            int
 	MQTTRedirectAddress string
+	MQTTRedirectToken   string // admin token of the upstream server
+	MQTTAuth            bool
+	MQTTUser            string
+	MQTTPassword        string
+	MQTTTLS             TLSConfig
+	HTTPTLS             TLSConfig
+	HTTPAuth            bool
+	RedirectQueuePath   string
+	RedirectQueueMaxMB  int
 	DbConfig            timeseries.DBConfig
+	DBSSLMode           string // sslmode of the transactions on postgres
 	TimeseriesTable     string
 	UploadInterval      int // in seconds
+	AlertWebhooks       []string
+	TopicMappings       []TopicMapping
+	Retention           []RetentionPolicy
+	RetentionInterval   int      // in seconds
+	Rollups             []string // "hourly" and/or "daily"
+	LineProtocolTag     string   // e.g. "{host}{measurement}{field}"
+	RemoteWriteTag      string   // e.g. "{instance}{__name__}", empty for name{labels}
 }
 
 func New(iotConfig IoTConfig) IoTEdge {
@@ -28,11 +45,21 @@ func New(iotConfig IoTConfig) IoTEdge {
 		Port:      iotConfig.Port,
 		IoTConfig: iotConfig,
 	}
+	if err := ValidateRetention(iotConfig.Retention, iotConfig.TimeseriesTable); err != nil {
+		log.Fatalf("invalid retention: %v", err)
+	}
+	setTxSSLMode(iotConfig.DBSSLMode)
 	s.DeviceDB = GetDeviceDB(iotConfig.DbConfig)
+	s.Alerts = GetAlertEngine(iotConfig)
 
 	if err := s.DeviceDB.CreateTimeseriesTable(iotConfig.TimeseriesTable); err != nil {
 		log.Fatalf("failed to create table: %v", err)
 	}
+	if len(iotConfig.Rollups) > 0 {
+		if err := s.DeviceDB.EnableRollups(iotConfig.TimeseriesTable, iotConfig.Rollups); err != nil {
+			log.Fatalf("failed to enable rollups: %v", err)
+		}
+	}
 	return s
 }
 
@@ -45,12 +72,29 @@ func GetConfig() IoTConfig {
 	viper.SetDefault("DBConfig.Password", "password")
 	viper.SetDefault("DBConfig.Port", 5432)
 	viper.SetDefault("DBConfig.TableName", "configs")
+	viper.SetDefault("DBSSLMode", "disable")
 	viper.SetDefault("TimeseriesTable", "measurements")
 
 	viper.SetDefault("Port", 3004)
 	viper.SetDefault("MQTTPort", 1883)
 	viper.SetDefault("MQTTRedirectAddress", "")
+	viper.SetDefault("MQTTRedirectToken", "")
+	viper.SetDefault("MQTTAuth", false)
+	viper.SetDefault("MQTTUser", "iotserver")
+	viper.SetDefault("MQTTPassword", "")
+	viper.SetDefault("MQTTTLS", TLSConfig{})
+	viper.SetDefault("HTTPTLS", TLSConfig{})
+	viper.SetDefault("HTTPAuth", false)
+	viper.SetDefault("RedirectQueuePath", "./redirect-queue.db")
+	viper.SetDefault("RedirectQueueMaxMB", 100)
 	viper.SetDefault("UploadInterval", 30)
+	viper.SetDefault("AlertWebhooks", []string{})
+	viper.SetDefault("TopicMappings", []TopicMapping{})
+	viper.SetDefault("Retention", []RetentionPolicy{})
+	viper.SetDefault("RetentionInterval", 3600)
+	viper.SetDefault("Rollups", []string{})
+	viper.SetDefault("LineProtocolTag", defaultLineProtocolTag)
+	viper.SetDefault("RemoteWriteTag", "")
 
 	viper.SetConfigName("iot")
 	viper.SetConfigType("json")
@@ -89,14 +133,40 @@ func GetConfig() IoTConfig {
 func (s *IoTEdge) StartSensorServer(stopChan chan bool) error {
 	logFields := log.Fields{"fnct": "startHTTPListener"}
 	router := gin.Default()
+	router.Use(metricsMiddleware)
 
-	router.POST(URIUploadData, s.UploadDataHandler)
-	router.POST(URISaveTimeseries, s.SaveTimeseries)
 	router.POST(URIInitDevice, s.InitDevice)
-	router.POST(URIUpdateSensor, s.UpdateSensorHandler)
-	router.POST(URISensorConfigure, s.ConfSensor)
-	router.POST(URIDeviceConfigure, s.ConfigureDevice)
-	router.POST(URILogging, s.Log)
+	router.GET(URIHealth, s.Health)
+	router.GET(URIReady, s.Ready)
+
+	ingest := router.Group("", s.RequireToken(false))
+	ingest.POST(URIUploadData, s.UploadDataHandler)
+	ingest.POST(URISaveTimeseries, s.SaveTimeseries)
+	ingest.POST(URIUpdateSensor, s.UpdateSensorHandler)
+	ingest.POST(URILogging, s.Log)
+	ingest.POST(URIWrite, s.WriteLineProtocol)
+	ingest.POST(URIWriteV2, s.WriteLineProtocol)
+	ingest.POST(URIRemoteWrite, s.RemoteWrite)
+
+	admin := router.Group("", s.RequireToken(true))
+	admin.POST(URISensorConfigure, s.ConfSensor)
+	admin.POST(URIDeviceConfigure, s.ConfigureDevice)
+	admin.GET(URIQueryTimeseries, s.QueryTimeseries)
+	admin.GET(URIExportTimeseries, s.Export)
+	admin.GET(URIDevices, s.ListDevices)
+	admin.GET(URIDevice, s.GetDevice)
+	admin.PATCH(URIDevice, s.UpdateDevice)
+	admin.DELETE(URIDevice, s.DeleteDevice)
+	admin.GET(URIDeviceSensors, s.ListSensors)
+	admin.PATCH(URIDeviceSensor, s.UpdateSensor)
+	admin.DELETE(URIDeviceSensor, s.DeleteSensor)
+	admin.GET(URIDeviceStatus, s.DeviceStatus)
+	admin.GET(URIAlerts, s.ListAlerts)
+	admin.GET(URIAlertRules, s.ListAlertRules)
+	admin.POST(URIAlertRules, s.AddAlertRule)
+	admin.DELETE(URIAlertRule, s.DeleteAlertRule)
+	admin.GET(URIMetrics, s.Metrics)
+	admin.GET(URILogs, s.GetLogs)
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%v", s.Port),
@@ -106,11 +176,32 @@ func (s *IoTEdge) StartSensorServer(stopChan chan bool) error {
 	// Channel to handle server errors
 	errChan := make(chan error, 1)
 
+	jobsStop := make(chan struct{})
+	defer close(jobsStop)
+	go s.Alerts.RunNoDataChecks(jobsStop)
+	go s.RunRetention(jobsStop)
+
+	if s.IoTConfig.HTTPTLS.Enabled() {
+		tlsConfig, err := s.IoTConfig.HTTPTLS.Load()
+		if err != nil {
+			log.WithFields(logFields).Errorf("Loading TLS config failed: %v.", err)
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	}
+
 	// Start server in goroutine
 	go func() {
 		fmt.Printf("Listen on port: %v\n", s.Port)
 		log.WithFields(logFields).Infof("HTTPListenerPort is %v. ", s.Port)
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if server.TLSConfig != nil {
+			// certificates are part of the TLSConfig
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			errChan <- err
 		}
 	}()
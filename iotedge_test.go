@@ -2,18 +2,42 @@ package iotedge
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"math/big"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
 	"github.com/google/uuid"
 	"github.com/pat-rohn/timeseries"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
 
 	"testing"
 )
@@ -67,6 +91,7 @@ func testMain(t *testing.T) {
 	dummy.init(t)
 
 	dummy.sendSensorData(t)
+	dummy.queryData(t)
 
 	dummy.DeviceDesc.Sensors = append(dummy.DeviceDesc.Sensors,
 		fmt.Sprintf("%sHumidity", name))
@@ -84,6 +109,8 @@ func testMain(t *testing.T) {
 		SensorOffset: -4.0,
 	}
 	dummy.configureSensor(t, configureSensorReq)
+	dummy.checkSensorOffset(t, configureSensorReq.SensorOffset)
+	dummy.checkRegistry(t, configureDeviceReq)
 	stopper <- true
 	time.Sleep(time.Second * 2)
 }
@@ -254,6 +281,104 @@ func (d *DummyDevice) sendData(t *testing.T, data *[]timeseries.TimeseriesImport
 	//fmt.Println(string(b))
 }
 
+func (d *DummyDevice) queryData(t *testing.T) {
+	start := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	resp, err := http.Get(fmt.Sprintf("%s%s?tag=%s&start=%s&bucket=1h&aggregate=max",
+		d.Url, URIQueryTimeseries, d.DeviceDesc.Sensors[0], start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Query failed with status: %s", resp.Status)
+	}
+	var rows []TimeseriesRow
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 || len(rows) > 2 {
+		t.Errorf("Expected downsampled rows, got %d", len(rows))
+	}
+}
+
+func (d *DummyDevice) checkSensorOffset(t *testing.T, offset float32) {
+	timestamp := time.Now().UTC()
+	data := []timeseries.TimeseriesImportStruct{{
+		Tag:        d.DeviceDesc.Sensors[0],
+		Timestamps: []string{timestamp.Format(TimestampFormat)},
+		Values:     []string{"20.0"},
+	}}
+	d.sendData(t, &data)
+
+	resp, err := http.Get(fmt.Sprintf("%s%s?tag=%s&start=%s",
+		d.Url, URIQueryTimeseries, d.DeviceDesc.Sensors[0],
+		timestamp.Add(-time.Millisecond).Format(time.RFC3339Nano)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var rows []TimeseriesRow
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("Expected 1 row, got %d", len(rows))
+	}
+	if rows[0].Value != 20.0+float64(offset) {
+		t.Errorf("Offset not applied: %v", rows[0].Value)
+	}
+	if rows[0].Comment != RawValueCommentPrefix+"20.0" {
+		t.Errorf("Raw value not preserved: '%s'", rows[0].Comment)
+	}
+}
+
+func (d *DummyDevice) checkRegistry(t *testing.T, conf ConfigureDeviceReq) {
+	deviceURL := d.Url + "/devices/" + d.DeviceDesc.Name
+	var dev Device
+	d.getJSON(t, deviceURL, http.StatusOK, &dev)
+	if dev.Interval != conf.Interval || dev.Buffer != conf.Buffer {
+		t.Errorf("Unexpected device config %+v", dev)
+	}
+	if dev.LastSeen == nil || dev.State(time.Now()) != DeviceStateOnline {
+		t.Errorf("Device should be online %+v", dev)
+	}
+	var sensors []Sensor
+	d.getJSON(t, deviceURL+"/sensors", http.StatusOK, &sensors)
+	if len(sensors) != len(d.DeviceDesc.Sensors) {
+		t.Errorf("Expected %d sensors, got %d", len(d.DeviceDesc.Sensors), len(sensors))
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, deviceURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Delete failed with status: %s", resp.Status)
+	}
+	d.getJSON(t, deviceURL, http.StatusNotFound, nil)
+}
+
+func (d *DummyDevice) getJSON(t *testing.T, url string, status int, v any) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("GET %s: expected %d, got %s", url, status, resp.Status)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func (d *DummyDevice) configureDevice(t *testing.T, configureDeviceReq ConfigureDeviceReq) {
 	jsonData, err := json.Marshal(configureDeviceReq)
 	if err != nil {
@@ -311,6 +436,59 @@ func TestMQTT(t *testing.T) {
 	time.Sleep(time.Second * 5) // would fail if data is not written
 }
 
+func TestMQTTShutdown(t *testing.T) {
+	log.SetLevel(log.WarnLevel)
+	config := GetConfig()
+	config.UploadInterval = 3600 // only the shutdown writes the data
+	iot := New(config)
+	broker := NewMQTTEdge(1887, config)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- broker.Start(context.Background())
+	}()
+	time.Sleep(time.Second * 2)
+
+	tag := "Shutdown" + uuid.NewString()
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://localhost:1887")
+	opts.SetClientID(tag)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	for i := range 5 {
+		client.Publish("shutdown/"+tag+"/data", 1, false, fmt.Sprintf("%d", i)).Wait()
+		time.Sleep(time.Millisecond * 10) // values are stored with receive time
+	}
+	client.Disconnect(250)
+	time.Sleep(time.Millisecond * 500)
+
+	var metrics bytes.Buffer
+	if err := serverMetrics.write(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	// the five values and the server's ping
+	if !bytes.Contains(metrics.Bytes(), []byte("iotedge_mqtt_buffered_points 6\n")) {
+		t.Errorf("Buffered values missing in metrics:\n%s", metrics.String())
+	}
+
+	broker.Stop()
+	if err := <-errChan; err != nil {
+		t.Fatalf("Broker stopped with error: %v", err)
+	}
+	rows, err := iot.DeviceDB.QueryTimeseries(config.TimeseriesTable, TimeseriesQuery{
+		Tags:  []string{tag},
+		Start: time.Now().Add(-time.Hour),
+		End:   time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 {
+		t.Errorf("Expected 5 buffered values written on shutdown, got %d", len(rows))
+	}
+}
+
 type TestHandler struct{}
 
 func (h *TestHandler) handleConnected(client mqtt.Client) {
@@ -361,7 +539,20 @@ func pubMQTTPaho(id int) {
 }
 
 func TestLogging(t *testing.T) {
+	testLogging(t, GetConfig(), &http.Client{}, "http")
+}
+
+func TestLoggingTLS(t *testing.T) {
+	certs := createTestCerts(t, "device1")
 	config := GetConfig()
+	config.HTTPTLS = TLSConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certs.pool}},
+	}
+	testLogging(t, config, client, "https")
+}
+
+func testLogging(t *testing.T, config IoTConfig, client *http.Client, scheme string) {
 	iot := New(config)
 	iot.Port = 3006
 
@@ -380,11 +571,9 @@ func TestLogging(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	client := http.Client{
-		Timeout: 40 * time.Second,
-	}
-	resp, err := client.Post(fmt.Sprintf("http://localhost:%d%s",
-		iot.Port, URILogging), "application/json",
+	client.Timeout = 40 * time.Second
+	resp, err := client.Post(fmt.Sprintf("%s://localhost:%d%s",
+		scheme, iot.Port, URILogging), "application/json",
 		bytes.NewBuffer(jsonData))
 	if err != nil {
 		t.Fatal(err)
@@ -396,3 +585,1883 @@ func TestLogging(t *testing.T) {
 	stopper <- true
 	time.Sleep(time.Second * 2)
 }
+
+type testCerts struct {
+	pool       *x509.CertPool
+	caFile     string
+	serverCert string
+	serverKey  string
+	clientCert tls.Certificate
+}
+
+// createTestCerts generates a self-signed CA with a server certificate for
+// localhost and a client certificate for the device.
+func createTestCerts(t *testing.T, device string) testCerts {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "iotedge test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func(serial int64, template *x509.Certificate) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(crand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+	serverCert, serverKey := issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	clientCert, clientKey := issue(3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: device},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	certs := testCerts{
+		pool:       x509.NewCertPool(),
+		caFile:     dir + "/ca.pem",
+		serverCert: dir + "/server.pem",
+		serverKey:  dir + "/server-key.pem",
+	}
+	certs.pool.AddCert(caCert)
+	files := map[string][]byte{
+		certs.caFile:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		certs.serverCert: serverCert,
+		certs.serverKey:  serverKey,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certs.clientCert, err = tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+func TestMQTTTLS(t *testing.T) {
+	log.SetLevel(log.WarnLevel)
+	name := "TLSDummy" + uuid.NewString()
+	certs := createTestCerts(t, name)
+	config := GetConfig()
+	config.MQTTAuth = true
+	config.MQTTUser = "iotserver"
+	config.MQTTPassword = "secret"
+	config.MQTTTLS = TLSConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey, ClientCAFile: certs.caFile}
+	iot := New(config)
+	if _, err := iot.Init(DeviceDesc{Name: name, Sensors: []string{name + "Temperature"}}); err != nil {
+		t.Fatal(err)
+	}
+	go StartMQTTBroker(1885, config)
+	time.Sleep(time.Second * 3)
+
+	connect := func(id string, tlsConfig *tls.Config, sensor string) error {
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker("ssl://localhost:1885")
+		opts.SetClientID(id)
+		opts.SetTLSConfig(tlsConfig)
+		opts.SetConnectRetry(false)
+		client := mqtt.NewClient(opts)
+		token := client.Connect()
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			return token.Error()
+		}
+		defer client.Disconnect(250)
+		pub := client.Publish(name+"/"+sensor+"/data", 1, false, "21.5")
+		if !pub.WaitTimeout(2 * time.Second) {
+			return fmt.Errorf("publish was not acknowledged")
+		}
+		return pub.Error()
+	}
+
+	withCert := &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.clientCert}}
+	if err := connect("tls-cert-client", withCert, name+"Temperature"); err != nil {
+		t.Errorf("Client with certificate was refused: %v", err)
+	}
+	// rejected data isn't acknowledged
+	if err := connect("tls-cert-client", withCert, "OtherTemperature"); err == nil {
+		t.Error("Client with certificate published a foreign tag")
+	}
+	if err := connect("tls-anonymous-client", &tls.Config{RootCAs: certs.pool}, name+"Temperature"); err == nil {
+		t.Error("Client without certificate or password was accepted")
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	events := make(chan AlertEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AlertEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer webhook.Close()
+
+	iot := New(GetConfig())
+	iot.Alerts.AddSink(&WebhookSink{URL: webhook.URL})
+	tag := "AlertDummy" + uuid.NewString() + "Temperature"
+	rule, err := iot.Alerts.AddRule(AlertRule{
+		Name:       "too hot",
+		Kind:       AlertKindThreshold,
+		Tag:        tag,
+		Operator:   ">",
+		Threshold:  30,
+		ForSeconds: 300,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iot.Alerts.DeleteRule(rule.ID)
+
+	expectEvent := func(state string) {
+		select {
+		case event := <-events:
+			if event.State != state || event.Rule.ID != rule.ID {
+				t.Errorf("Expected %s for rule %d, got %+v", state, rule.ID, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s event received", state)
+		}
+	}
+
+	start := time.Now().UTC()
+	iot.Alerts.Evaluate(tag, start, 31)
+	iot.Alerts.Evaluate(tag, start.Add(4*time.Minute), 32)
+	select {
+	case event := <-events:
+		t.Fatalf("Fired before the hold time: %+v", event)
+	case <-time.After(500 * time.Millisecond):
+	}
+	iot.Alerts.Evaluate(tag, start.Add(5*time.Minute), 33)
+	expectEvent(AlertFiring)
+	iot.Alerts.Evaluate(tag, start.Add(6*time.Minute), 20)
+	expectEvent(AlertResolved)
+}
+
+func TestAlertsAfterInsert(t *testing.T) {
+	events := make(chan AlertEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AlertEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer webhook.Close()
+
+	iot := New(GetConfig())
+	iot.Alerts.AddSink(&WebhookSink{URL: webhook.URL})
+	tag := "AlertDummy" + uuid.NewString() + "Temperature"
+	rule, err := iot.Alerts.AddRule(AlertRule{Name: "too hot", Kind: AlertKindThreshold, Tag: tag, Operator: ">", Threshold: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iot.Alerts.DeleteRule(rule.ID)
+	router := gin.New()
+	router.POST(URISaveTimeseries, iot.SaveTimeseries)
+	post := func(data []timeseries.TimeseriesImportStruct) int {
+		body, _ := json.Marshal(data)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, URISaveTimeseries, bytes.NewReader(body)))
+		return rec.Code
+	}
+
+	now := time.Now().UTC().Format(TimestampFormat)
+	hot := timeseries.TimeseriesImportStruct{Tag: tag, Timestamps: []string{now}, Values: []string{"31"}}
+	invalid := timeseries.TimeseriesImportStruct{Tag: tag + "Invalid", Timestamps: []string{now}, Values: []string{"warm"}}
+	if code := post([]timeseries.TimeseriesImportStruct{hot, invalid}); code != http.StatusBadRequest {
+		t.Fatalf("Expected refused batch, got %d", code)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("Alert of refused data: %+v", event)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if code := post([]timeseries.TimeseriesImportStruct{hot}); code != http.StatusOK {
+		t.Fatalf("Expected stored batch, got %d", code)
+	}
+	select {
+	case event := <-events:
+		if event.State != AlertFiring || event.Rule.ID != rule.ID {
+			t.Errorf("Expected %s for rule %d, got %+v", AlertFiring, rule.ID, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No alert of stored data")
+	}
+}
+
+func TestForwardQueue(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan []timeseries.TimeseriesImportStruct, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var data []timeseries.TimeseriesImportStruct
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Error(err)
+		}
+		received <- data
+	}))
+	defer upstream.Close()
+
+	queue, err := OpenForwardQueue(t.TempDir()+"/queue.db", upstream.URL, "", 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	queue.minBackoff = 10 * time.Millisecond
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go queue.Run(stop)
+
+	batch := []timeseries.TimeseriesImportStruct{{
+		Tag:        "QueueDummyTemperature",
+		Timestamps: []string{time.Now().UTC().Format(TimestampFormat)},
+		Values:     []string{"21.5"},
+	}}
+	if err := queue.Enqueue(batch); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if len(data) != 1 || data[0].Tag != batch[0].Tag {
+			t.Errorf("Unexpected batch %+v", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Batch was not forwarded")
+	}
+	time.Sleep(100 * time.Millisecond)
+	stats, err := queue.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Depth != 0 || stats.Sent != 1 || stats.Failed != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	queue.maxBytes = 1
+	if err := queue.Enqueue(batch); err == nil {
+		t.Error("Batch larger than the queue was accepted")
+	}
+	if stats, _ := queue.Stats(); stats.Dropped != 1 || stats.Depth != 0 {
+		t.Errorf("Queue is not bounded %+v", stats)
+	}
+}
+
+func TestForwardQueueToken(t *testing.T) {
+	auth := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	queue, err := OpenForwardQueue(t.TempDir()+"/queue.db", upstream.URL, "upstream-token", 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go queue.Run(stop)
+
+	batch := []timeseries.TimeseriesImportStruct{{
+		Tag:        "QueueDummyTemperature",
+		Timestamps: []string{time.Now().UTC().Format(TimestampFormat)},
+		Values:     []string{"21.5"},
+	}}
+	if err := queue.Enqueue(batch); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case header := <-auth:
+		if header != "Bearer upstream-token" {
+			t.Errorf("Unexpected Authorization header %q", header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Batch was not forwarded")
+	}
+}
+
+func TestForwardQueueDeadBatches(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan []timeseries.TimeseriesImportStruct, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data []timeseries.TimeseriesImportStruct
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Error(err)
+		}
+		if data[0].Tag == "QueueInvalid" {
+			calls.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- data
+	}))
+	defer upstream.Close()
+
+	queue, err := OpenForwardQueue(t.TempDir()+"/queue.db", upstream.URL, "", 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	queue.minBackoff = time.Millisecond
+
+	now := time.Now().UTC().Format(TimestampFormat)
+	for _, tag := range []string{"QueueInvalid", "QueueDummyTemperature"} {
+		batch := []timeseries.TimeseriesImportStruct{{Tag: tag, Timestamps: []string{now}, Values: []string{"21.5"}}}
+		if err := queue.Enqueue(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go queue.Run(stop)
+
+	select {
+	case data := <-received:
+		if data[0].Tag != "QueueDummyTemperature" {
+			t.Errorf("Unexpected batch %+v", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Refused batch blocks the queue")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if calls.Load() != maxRejectedAttempts {
+		t.Errorf("Refused batch was sent %d times", calls.Load())
+	}
+	stats, err := queue.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Depth != 0 || stats.Dead != 1 || stats.Sent != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+type flakyInserter struct {
+	mutex       sync.Mutex
+	failures    int
+	points      int
+	deadLetters int
+}
+
+func (f *flakyInserter) InsertTimeseriesBatch(data []timeseries.TimeseriesImportStruct, table string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return fmt.Errorf("database is locked")
+	}
+	f.points += countPoints(data)
+	return nil
+}
+
+func (f *flakyInserter) InsertDeadLetters(data []timeseries.TimeseriesImportStruct, table string, reason string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deadLetters += countPoints(data)
+	return nil
+}
+
+func TestTimeseriesWriter(t *testing.T) {
+	db := &flakyInserter{failures: 3}
+	writer := newTimeseriesWriter(db, "measurements")
+	writer.minBackoff = time.Millisecond
+	var writes atomic.Int32
+	writer.onWritten = func([]timeseries.TimeseriesImportStruct) { writes.Add(1) }
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for i := range 5 {
+		writer.Add([]timeseries.TimeseriesImportStruct{{
+			Tag:        fmt.Sprintf("WriterDummy%dTemperature", i),
+			Timestamps: []string{"2024-01-01 00:00:00.000", "2024-01-01 00:00:01.000"},
+			Values:     []string{"1", "2"},
+		}})
+	}
+	// all batches are pending before the first write, so it fails with
+	// all 10 points three times
+	go writer.Run(stop)
+	endTime := time.Now().Add(5 * time.Second)
+	for writer.Stats().Written < 10 && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := writer.Stats()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if stats.Written != 10 || stats.Pending != 0 || db.points != 10 {
+		t.Errorf("Data was lost: %+v", stats)
+	}
+	if stats.Retried != 30 || stats.Delayed != 30 {
+		t.Errorf("Unexpected counters: %+v", stats)
+	}
+	if writes.Load() != 1 {
+		t.Errorf("Expected one successful write, got %d", writes.Load())
+	}
+}
+
+func TestTimeseriesWriterDeadLetters(t *testing.T) {
+	db := &flakyInserter{}
+	writer := newTimeseriesWriter(db, "measurements")
+	writer.maxPending = 5
+	point := func(tag string, value string) []timeseries.TimeseriesImportStruct {
+		return []timeseries.TimeseriesImportStruct{{Tag: tag, Timestamps: []string{"2024-01-01 00:00:00.000"}, Values: []string{value}}}
+	}
+	writer.Add(point("WriterDropped", "1"))
+	for i := range 4 {
+		writer.Add(point(fmt.Sprintf("WriterValid%d", i), "1"))
+	}
+	writer.Add(point("WriterInvalid", "warm"))
+	if stats := writer.Stats(); stats.Pending != 5 || stats.Dropped != 1 {
+		t.Errorf("Expected the oldest point to be dropped: %+v", stats)
+	}
+	if err := writer.Flush(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stats := writer.Stats()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if stats.Written != 4 || stats.DeadLettered != 1 || db.points != 4 || db.deadLetters != 1 {
+		t.Errorf("Expected the invalid point in the dead letters: %+v", stats)
+	}
+
+	iot := New(GetConfig())
+	data := point("DeadLetter"+uuid.NewString(), "warm")
+	if err := iot.DeviceDB.InsertDeadLetters(data, "measurements", "invalid value"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := iot.DeviceDB.countRows("dead_letters", "payload LIKE ?", []interface{}{"%" + data[0].Tag + "%"}); err != nil || count != 1 {
+		t.Errorf("Expected the dead letter to be stored, got %d: %v", count, err)
+	}
+}
+
+func TestOpenTxDB(t *testing.T) {
+	iot := New(GetConfig())
+	rows, err := iot.DeviceDB.ExecuteQuery("PRAGMA busy_timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeout int
+	if rows.Next() {
+		rows.Scan(&timeout)
+	}
+	rows.Close()
+	if timeout != sqliteBusyTimeout {
+		t.Errorf("Library pool has busy_timeout %d", timeout)
+	}
+
+	setTxSSLMode("verify-full")
+	defer setTxSSLMode("disable")
+	config := timeseries.DBConfig{Name: "iot", IPOrPath: "db.local", UsePostgres: true, User: "edge", Password: "p w'd@1", Port: 5432}
+	if _, err := openTxDB(config); err != nil {
+		t.Fatal(err)
+	}
+	for dsn := range txDBs {
+		u, err := url.Parse(dsn)
+		if err != nil || u.Host != "db.local:5432" {
+			continue
+		}
+		if password, _ := u.User.Password(); password != config.Password || u.Query().Get("sslmode") != "verify-full" {
+			t.Errorf("Unexpected DSN %s", dsn)
+		}
+		return
+	}
+	t.Error("Postgres pool was not opened")
+}
+
+func TestConfigureUnknownDevice(t *testing.T) {
+	iot := New(GetConfig())
+	router := gin.New()
+	router.POST(URIDeviceConfigure, iot.ConfigureDevice)
+	router.POST(URISensorConfigure, iot.ConfSensor)
+	name := "UnknownDummy" + uuid.NewString()
+	for uri, req := range map[string]any{
+		URIDeviceConfigure: ConfigureDeviceReq{Name: name, Interval: 10, Buffer: 1},
+		URISensorConfigure: ConfigureSensorReq{Name: name, SensorName: name + "Temperature", SensorOffset: 1},
+	} {
+		body, _ := json.Marshal(req)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, uri, bytes.NewReader(body)))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s of unknown device: expected 404, got %d", uri, rec.Code)
+		}
+	}
+}
+
+func TestInsertTimeseriesBatch(t *testing.T) {
+	config := GetConfig()
+	iot := New(config)
+	prefix := "Batch" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	data := benchmarkData(1, 2*batchRows, start)
+	data[0].Tag = prefix + "Valid"
+	data = append(data, timeseries.TimeseriesImportStruct{Tag: prefix + "Invalid",
+		Timestamps: []string{start.Format(TimestampFormat)}, Values: []string{"warm"}})
+
+	var invalid *InvalidTimeseriesError
+	if err := iot.DeviceDB.InsertTimeseriesBatch(data, config.TimeseriesTable); !errors.As(err, &invalid) || invalid.Tag != prefix+"Invalid" {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	query := TimeseriesQuery{Tags: []string{prefix + "*"}, Start: start, End: start.Add(time.Hour)}
+	if rows, err := iot.DeviceDB.QueryTimeseries(config.TimeseriesTable, query); err != nil || len(rows) != 0 {
+		t.Errorf("Expected nothing to be written, got %d rows: %v", len(rows), err)
+	}
+
+	router := gin.New()
+	router.POST(URISaveTimeseries, iot.SaveTimeseries)
+	body, _ := json.Marshal(data[1:])
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, URISaveTimeseries, bytes.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid data, got %d", rec.Code)
+	}
+
+	if err := iot.DeviceDB.InsertTimeseriesBatch(data[:1], config.TimeseriesTable); err != nil {
+		t.Fatal(err)
+	}
+	if rows, err := iot.DeviceDB.QueryTimeseries(config.TimeseriesTable, query); err != nil || len(rows) != 2*batchRows {
+		t.Errorf("Expected %d rows, got %d: %v", 2*batchRows, len(rows), err)
+	}
+
+	// the same instant in other formats is stored once and found by queries
+	offsets := []timeseries.TimeseriesImportStruct{{Tag: prefix + "Offset",
+		Timestamps: []string{"2024-03-01T02:00:30+02:00", "2024-03-01 00:00:30.000", "2024-03-01T00:01:00Z"},
+		Values:     []string{"1", "2", "3"}}}
+	if err := iot.DeviceDB.InsertTimeseriesBatch(offsets, config.TimeseriesTable); err != nil {
+		t.Fatal(err)
+	}
+	query = TimeseriesQuery{Tags: []string{prefix + "Offset"}, Start: start, End: start.Add(45 * time.Second)}
+	rows, err := iot.DeviceDB.QueryTimeseries(config.TimeseriesTable, query)
+	if err != nil || len(rows) != 1 || rows[0].Value != 1 || !rows[0].Time.Equal(start.Add(30*time.Second)) {
+		t.Errorf("Expected one normalized row, got %+v: %v", rows, err)
+	}
+}
+
+func benchmarkData(tags int, points int, start time.Time) []timeseries.TimeseriesImportStruct {
+	var data []timeseries.TimeseriesImportStruct
+	for i := range tags {
+		ts := timeseries.TimeseriesImportStruct{Tag: fmt.Sprintf("BenchDummy%dTemperature", i)}
+		for j := range points {
+			ts.Timestamps = append(ts.Timestamps, start.Add(time.Duration(j)*time.Second).Format(TimestampFormat))
+			ts.Values = append(ts.Values, fmt.Sprintf("%f", rand.Float32()*100))
+		}
+		data = append(data, ts)
+	}
+	return data
+}
+
+func benchmarkInsert(b *testing.B, insert func(db *DeviceDB, data []timeseries.TimeseriesImportStruct, table string) error) {
+	log.SetLevel(log.ErrorLevel)
+	table := "bench_measurements"
+	db := GetDeviceDB(GetConfig().DbConfig)
+	if err := db.CreateTimeseriesTable(table); err != nil {
+		b.Fatal(err)
+	}
+	start := time.Now().UTC()
+	b.ResetTimer()
+	for i := range b.N {
+		data := benchmarkData(200, 5, start.Add(time.Duration(i)*time.Minute))
+		if err := insert(db, data, table); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInsertTimeseries(b *testing.B) {
+	benchmarkInsert(b, func(db *DeviceDB, data []timeseries.TimeseriesImportStruct, table string) error {
+		for _, ts := range data {
+			if err := db.InsertTimeseries(ts, true, table); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkInsertTimeseriesBatch(b *testing.B) {
+	benchmarkInsert(b, func(db *DeviceDB, data []timeseries.TimeseriesImportStruct, table string) error {
+		return db.InsertTimeseriesBatch(data, table)
+	})
+}
+
+func TestParseMQTTPayload(t *testing.T) {
+	received := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	plain, err := parseMQTTPayload("Basel3Temperature", " 21.5 ", received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain) != 1 || plain[0].Tag != "Basel3Temperature" || plain[0].Value != "21.5" ||
+		plain[0].Timestamp != "2024-05-01 12:00:00.000" {
+		t.Errorf("Unexpected plain measurement %+v", plain)
+	}
+
+	payload := `{"ts": "2024-05-01T11:59:30Z", "values": {"Temperature": 21.3, "Humidity": 40}, "tags": ["v1.2", "indoor"]}`
+	measurements, err := parseMQTTPayload("Basel3", payload, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []mqttMeasurement{
+		{Tag: "Basel3Humidity", Value: "40", Timestamp: "2024-05-01 11:59:30.000", Comment: "v1.2;indoor"},
+		{Tag: "Basel3Temperature", Value: "21.3", Timestamp: "2024-05-01 11:59:30.000", Comment: "v1.2;indoor"},
+	}
+	if fmt.Sprint(measurements) != fmt.Sprint(expected) {
+		t.Errorf("Expected %+v, got %+v", expected, measurements)
+	}
+
+	epoch, err := parseMQTTPayload("Basel3", `{"ts": 1714564770000, "values": {"Temperature": 1}}`, received)
+	if err != nil || epoch[0].Timestamp != "2024-05-01 11:59:30.000" {
+		t.Errorf("Unexpected epoch measurement %+v: %v", epoch, err)
+	}
+
+	for _, invalid := range []string{"abc", `{"values": {}}`, `{"values": {"T": "x"}}`, `{"ts": "yesterday", "values": {"T": 1}}`} {
+		if _, err := parseMQTTPayload("Basel3", invalid, received); err == nil {
+			t.Errorf("Expected error for %s", invalid)
+		}
+	}
+}
+
+func TestTopicMapper(t *testing.T) {
+	mapper, err := newTopicMapper([]TopicMapping{
+		{Topic: "site/{site}/{device}/{sensor}/data", Tag: "{device}{sensor}"},
+		{Topic: "shellies/{device}/sensor/{sensor}", Tag: "{device}{sensor}"},
+		{Topic: "tele/{device}/+/#", Tag: "{device}Tele"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"site/basel/Basel3/Temperature/data":  "Basel3Temperature",
+		"shellies/shellyht1/sensor/humidity":  "shellyht1humidity",
+		"tele/tasmota1/SENSOR/a/b/c":          "tasmota1Tele",
+		"a/b/c/d/e/f/g/h/Basel4Humidity/data": "Basel4Humidity",
+		"pahoClient/test/Temperature1/data":   "Temperature1",
+		"/server/ping/data":                   "ping",
+	}
+	for topic, expected := range tests {
+		if tag, ok := mapper.Tag(topic); !ok || tag != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", topic, expected, tag, ok)
+		}
+	}
+	for _, topic := range []string{"Basel3/data", "shellies/shellyht1/sensor", "devices/Basel3/config"} {
+		if tag, ok := mapper.Tag(topic); ok {
+			t.Errorf("%s should be ignored, got %s", topic, tag)
+		}
+	}
+	if _, err := newTopicMapper([]TopicMapping{{Topic: "a/#/b", Tag: "x"}}); err == nil {
+		t.Error("Expected error for '#' in the middle")
+	}
+}
+
+func TestMQTTAuth(t *testing.T) {
+	config := GetConfig()
+	config.MQTTUser = "iotserver"
+	config.MQTTPassword = "secret"
+	iot := New(config)
+	name := "AuthDummy" + uuid.NewString()
+	if _, err := iot.Init(DeviceDesc{Name: name, Sensors: []string{name + "Temperature"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := iot.DeviceDB.SetMQTTPassword(name, "devicepw"); err != nil {
+		t.Fatal(err)
+	}
+	mapper, err := newTopicMapper(config.TopicMappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := newMQTTAuth(iot.DeviceDB, config, mapper)
+
+	if !auth.Authenticate([]byte("iotserver"), []byte("secret")) {
+		t.Error("Server client must be able to connect")
+	}
+	if !auth.Authenticate([]byte(name), []byte("devicepw")) {
+		t.Error("Device must be able to connect")
+	}
+	if auth.Authenticate([]byte(name), []byte("wrong")) || auth.Authenticate([]byte(""), []byte("")) {
+		t.Error("Invalid credentials accepted")
+	}
+	noPassword := config
+	noPassword.MQTTAuth = true
+	noPassword.MQTTPassword = ""
+	if err := NewMQTTEdge(1889, noPassword).Start(context.Background()); err == nil {
+		t.Error("Broker started with MQTTAuth but without MQTTPassword")
+	}
+	if newMQTTAuth(iot.DeviceDB, noPassword, mapper).Authenticate([]byte("iotserver"), []byte("")) {
+		t.Error("Server client connected with empty password")
+	}
+	if !auth.ACL([]byte(name), name+"/Temperature/data", true) {
+		t.Error("Device must publish below its own prefix")
+	}
+	if auth.ACL([]byte(name), "Other/Temperature/data", true) {
+		t.Error("Device must not publish on foreign topics")
+	}
+	if !auth.ACL([]byte("iotserver"), "#", false) {
+		t.Error("Server client must subscribe to everything")
+	}
+	if !auth.ACL([]byte(name), deviceConfigTopic(name), false) || !auth.ACL([]byte(name), deviceConfigAckTopic(name), true) {
+		t.Error("Device must read its config and publish the ack")
+	}
+	if auth.ACL([]byte(name), deviceConfigTopic(name), true) || auth.ACL([]byte(name), deviceConfigTopic("Other"), false) {
+		t.Error("Device must not change its config or read foreign configs")
+	}
+
+	// the ACL allows the prefix, the tags must be sensors of the device
+	now := time.Now()
+	if !auth.CheckPublish(name, name+"/"+name+"Temperature/data", []byte("21.5"), now) {
+		t.Error("Device must publish its own sensor")
+	}
+	if !auth.CheckPublish("iotserver", "Other/OtherTemperature/data", []byte("21.5"), now) {
+		t.Error("Server client must publish everything")
+	}
+	if auth.CheckPublish(name, name+"/OtherTemperature/data", []byte("21.5"), now) {
+		t.Error("Device must not publish foreign tags")
+	}
+	if auth.CheckPublish(name, name+"/"+name+"/data", []byte(`{"values": {"Humidity": 40}}`), now) {
+		t.Error("Device must not publish unknown sensors in the payload")
+	}
+	other := "AuthDummy" + uuid.NewString()
+	if _, err := iot.Init(DeviceDesc{Name: other, Sensors: []string{name + "Temperature"}}); !errors.Is(err, ErrSensorOfOtherDevice) {
+		t.Errorf("Device registered a foreign sensor: %v", err)
+	}
+	if err := iot.DeviceDB.SetMQTTPassword(other, "otherpw"); err != nil {
+		t.Fatal(err)
+	}
+	if auth.CheckPublish(other, other+"/"+name+"Temperature/data", []byte("21.5"), now) {
+		t.Error("Device must not publish the sensor it tried to take over")
+	}
+	for _, reserved := range []string{"iotserver", "devices", "devicesX"} {
+		if _, err := iot.Init(DeviceDesc{Name: reserved}); !errors.Is(err, ErrReservedDeviceName) {
+			t.Errorf("Device with reserved name %s was initialized: %v", reserved, err)
+		}
+	}
+	// devices registered before the names were reserved
+	if auth.ACL([]byte("devices"), deviceConfigTopic(name), true) || auth.ACL([]byte("devices"), deviceConfigAckTopic(name), true) {
+		t.Error("Device named devices must not write foreign config topics")
+	}
+	if auth.ACL([]byte("devices"), deviceConfigTopic(name), false) {
+		t.Error("Device named devices must not read foreign config topics")
+	}
+
+	// refusals of a device are logged once per denyLogInterval
+	if _, ok := auth.mayLogDenied("RateDummy", now); !ok {
+		t.Error("First refusal must be logged")
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := auth.mayLogDenied("RateDummy", now.Add(time.Second)); ok {
+			t.Error("Refusals within denyLogInterval must not be logged")
+		}
+	}
+	if suppressed, ok := auth.mayLogDenied("RateDummy", now.Add(denyLogInterval)); !ok || suppressed != 3 {
+		t.Errorf("Expected the next refusal with 3 left out, got %d %v", suppressed, ok)
+	}
+
+	// random names can't log more than the global limit
+	logged := 0
+	later := now.Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		if _, ok := auth.mayLogDenied(fmt.Sprintf("RandomDummy%d", i), later); ok {
+			logged++
+		}
+	}
+	if logged != denyLogBurst {
+		t.Errorf("Expected %d refusals of random names to be logged, got %d", denyLogBurst, logged)
+	}
+	if _, ok := auth.mayLogDenied("RandomDummyNext", later.Add(denyLogRefill)); !ok {
+		t.Error("Refusal after the refill must be logged")
+	}
+}
+
+func TestMQTTConfig(t *testing.T) {
+	log.SetLevel(log.WarnLevel)
+	config := GetConfig()
+	iot := New(config)
+	name := "ConfigDummy" + uuid.NewString()
+	dev, err := iot.Init(DeviceDesc{Name: name, Sensors: []string{name + "Temperature"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go StartMQTTBroker(1886, config)
+	time.Sleep(time.Second * 3)
+
+	configs := make(chan DeviceConfig, 10)
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://localhost:1886")
+	opts.SetClientID(name)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(250)
+	client.Subscribe(deviceConfigTopic(name), 1, func(c mqtt.Client, msg mqtt.Message) {
+		var conf DeviceConfig
+		if err := json.Unmarshal(msg.Payload(), &conf); err != nil {
+			t.Errorf("Invalid config payload %s: %v", msg.Payload(), err)
+			return
+		}
+		configs <- conf
+	}).Wait()
+	nextConfig := func() DeviceConfig {
+		select {
+		case conf := <-configs:
+			return conf
+		case <-time.After(5 * time.Second):
+			t.Fatal("No config received")
+		}
+		return DeviceConfig{}
+	}
+
+	// retained config published on startup
+	conf := nextConfig()
+	if conf.Version != 0 || conf.Interval != dev.Interval {
+		t.Errorf("Unexpected initial config %+v", conf)
+	}
+
+	dev.Interval = 30
+	if err := iot.DeviceDB.Configure(dev); err != nil {
+		t.Fatal(err)
+	}
+	if conf = nextConfig(); conf.Version != 1 || conf.Interval != 30 {
+		t.Errorf("Unexpected config %+v", conf)
+	}
+	sensor := Sensor{DeviceID: dev.ID, Name: name + "Temperature", SensorOffset: -1.5}
+	if err := iot.DeviceDB.ConfigureSensor(sensor); err != nil {
+		t.Fatal(err)
+	}
+	if conf = nextConfig(); conf.Version != 2 || conf.SensorOffsets[sensor.Name] != -1.5 {
+		t.Errorf("Unexpected config %+v", conf)
+	}
+
+	client.Publish(deviceConfigAckTopic(name), 1, false, `{"Version": 2}`).Wait()
+	for i := 0; i < 50; i++ {
+		if dev, err = iot.DeviceDB.GetDevice(name); err != nil {
+			t.Fatal(err)
+		}
+		if dev.AppliedConfigVersion == 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if dev.ConfigVersion != 2 || dev.AppliedConfigVersion != 2 {
+		t.Errorf("Expected config version 2 applied, got %d/%d", dev.AppliedConfigVersion, dev.ConfigVersion)
+	}
+	if err := iot.DeviceDB.SetAppliedConfigVersion(name, 3); err == nil {
+		t.Errorf("Expected unpublished config version to be refused")
+	}
+
+	if sensor, err = iot.DeviceDB.GetSensor(dev.ID, sensor.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := iot.DeviceDB.DeleteSensor(sensor); err != nil {
+		t.Fatal(err)
+	}
+	if conf = nextConfig(); conf.Version != 3 || len(conf.SensorOffsets) != 0 {
+		t.Errorf("Unexpected config after deleting sensor %+v", conf)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	config := GetConfig()
+	config.HTTPAuth = true
+	iot := New(config)
+	iot.Port = 3007
+	stopper := make(chan bool)
+	go func() {
+		iot.StartSensorServer(stopper)
+	}()
+	defer func() {
+		stopper <- true
+		time.Sleep(time.Second * 2)
+	}()
+	time.Sleep(time.Second * 2)
+
+	url := fmt.Sprintf("http://localhost:%d", iot.Port)
+	request := func(method string, uri string, token string, body any) *http.Response {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(method, url+uri, bytes.NewBuffer(jsonData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	statusOf := func(resp *http.Response) int {
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	name := "TokenDummy" + uuid.NewString()
+	initReq := map[string]DeviceDesc{"Device": {Name: name, Sensors: []string{name + "Temperature"}}}
+	resp := request(http.MethodPost, URIInitDevice, "", initReq)
+	var initResp InitDeviceResponse
+	json.NewDecoder(resp.Body).Decode(&initResp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || initResp.Token == "" {
+		t.Fatalf("Init should issue a token: %s %+v", resp.Status, initResp)
+	}
+	if code := statusOf(request(http.MethodPost, URIInitDevice, "", initReq)); code != http.StatusUnauthorized {
+		t.Errorf("Re-init without token: expected 401, got %d", code)
+	}
+
+	data := []timeseries.TimeseriesImportStruct{{
+		Tag:        name + "Temperature",
+		Timestamps: []string{time.Now().UTC().Format(TimestampFormat)},
+		Values:     []string{"21.5"},
+	}}
+	if code := statusOf(request(http.MethodPost, URIUploadData, "", data)); code != http.StatusUnauthorized {
+		t.Errorf("Upload without token: expected 401, got %d", code)
+	}
+	if code := statusOf(request(http.MethodPost, URIUploadData, initResp.Token, data)); code != http.StatusOK {
+		t.Errorf("Upload with device token: expected 200, got %d", code)
+	}
+
+	// InfluxDB clients use the Token scheme
+	lineReq, _ := http.NewRequest(http.MethodPost, url+URIWrite, strings.NewReader(name+" Temperature=21.5"))
+	lineReq.Header.Set("Authorization", "Token "+initResp.Token)
+	lineResp, err := http.DefaultClient.Do(lineReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := statusOf(lineResp); code != http.StatusNoContent {
+		t.Errorf("Line protocol with device token: expected 204, got %d", code)
+	}
+
+	// device tokens may only write their own sensors and messages
+	other := "TokenDummy" + uuid.NewString()
+	otherInit := map[string]DeviceDesc{"Device": {Name: other, Sensors: []string{other + "Temperature"}}}
+	if code := statusOf(request(http.MethodPost, URIInitDevice, "", otherInit)); code != http.StatusOK {
+		t.Fatalf("Init of second device: expected 200, got %d", code)
+	}
+	// a device can't register the sensor of another one to write it
+	evilInit := map[string]DeviceDesc{"Device": {Name: "Evil" + other, Sensors: []string{name + "Temperature"}}}
+	if code := statusOf(request(http.MethodPost, URIInitDevice, "", evilInit)); code != http.StatusConflict {
+		t.Errorf("Init with sensor of other device: expected 409, got %d", code)
+	}
+	if err := iot.DeviceDB.InsertSensor(Sensor{Name: name + "Temperature", DeviceID: -1}); err == nil {
+		t.Error("Sensor name was registered twice")
+	}
+	for _, tag := range []string{other + "Temperature", name + "Unknown"} {
+		foreign := []timeseries.TimeseriesImportStruct{{Tag: tag, Timestamps: data[0].Timestamps, Values: data[0].Values}}
+		for _, uri := range []string{URIUploadData, URISaveTimeseries} {
+			if code := statusOf(request(http.MethodPost, uri, initResp.Token, foreign)); code != http.StatusForbidden {
+				t.Errorf("%s of %s with device token: expected 403, got %d", uri, tag, code)
+			}
+		}
+		sensorReq := sensorValues{Data: []TimeSeriesValue{{Name: tag, Value: 21.5}}}
+		if code := statusOf(request(http.MethodPost, URIUpdateSensor, initResp.Token, sensorReq)); code != http.StatusForbidden {
+			t.Errorf("Update sensor %s with device token: expected 403, got %d", tag, code)
+		}
+	}
+	lineReq, _ = http.NewRequest(http.MethodPost, url+URIWriteV2, strings.NewReader(other+" Temperature=21.5"))
+	lineReq.Header.Set("Authorization", "Token "+initResp.Token)
+	if lineResp, err = http.DefaultClient.Do(lineReq); err != nil {
+		t.Fatal(err)
+	}
+	if code := statusOf(lineResp); code != http.StatusForbidden {
+		t.Errorf("Line protocol of other device: expected 403, got %d", code)
+	}
+	if code := statusOf(request(http.MethodPost, URILogging, initResp.Token, LogMessage{Device: other, Text: "reset"})); code != http.StatusForbidden {
+		t.Errorf("Log as other device: expected 403, got %d", code)
+	}
+	if code := statusOf(request(http.MethodPost, URILogging, initResp.Token, LogMessage{Device: name, Text: "reset"})); code != http.StatusOK {
+		t.Errorf("Log as own device: expected 200, got %d", code)
+	}
+
+	conf := ConfigureDeviceReq{Name: name, Interval: 10, Buffer: 1}
+	if code := statusOf(request(http.MethodPost, URIDeviceConfigure, initResp.Token, conf)); code != http.StatusForbidden {
+		t.Errorf("Configure with device token: expected 403, got %d", code)
+	}
+	adminToken, err := iot.DeviceDB.IssueAdminToken("test-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iot.DeviceDB.RevokeAdminToken("test-admin")
+	if code := statusOf(request(http.MethodPost, URIDeviceConfigure, adminToken, conf)); code != http.StatusOK {
+		t.Errorf("Configure with admin token: expected 200, got %d", code)
+	}
+	foreign := []timeseries.TimeseriesImportStruct{{Tag: other + "Temperature", Timestamps: data[0].Timestamps, Values: data[0].Values}}
+	if code := statusOf(request(http.MethodPost, URISaveTimeseries, adminToken, foreign)); code != http.StatusOK {
+		t.Errorf("Save with admin token: expected 200, got %d", code)
+	}
+
+	if err := iot.DeviceDB.RevokeDeviceToken(name); err != nil {
+		t.Fatal(err)
+	}
+	if code := statusOf(request(http.MethodPost, URIUploadData, initResp.Token, data)); code != http.StatusUnauthorized {
+		t.Errorf("Upload with revoked token: expected 401, got %d", code)
+	}
+	for _, token := range []string{"", initResp.Token} {
+		if code := statusOf(request(http.MethodPost, URIInitDevice, token, initReq)); code != http.StatusUnauthorized {
+			t.Errorf("Re-init of revoked device: expected 401, got %d", code)
+		}
+	}
+	resp = request(http.MethodPost, URIInitDevice, adminToken, initReq)
+	var reinitResp InitDeviceResponse
+	json.NewDecoder(resp.Body).Decode(&reinitResp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || reinitResp.Token == "" || reinitResp.Token == initResp.Token {
+		t.Errorf("Re-init with admin token should issue a new token: %s %+v", resp.Status, reinitResp)
+	}
+
+	// devices registered before HTTPAuth was enabled have no token
+	legacy := "TokenDummy" + uuid.NewString()
+	if _, err := iot.DeviceDB.GetOrCreateDevice(DeviceDesc{Name: legacy}); err != nil {
+		t.Fatal(err)
+	}
+	legacyInit := map[string]DeviceDesc{"Device": {Name: legacy}}
+	if code := statusOf(request(http.MethodPost, URIInitDevice, "", legacyInit)); code != http.StatusUnauthorized {
+		t.Errorf("Init of known device without token: expected 401, got %d", code)
+	}
+	if code := statusOf(request(http.MethodPost, URIInitDevice, adminToken, legacyInit)); code != http.StatusOK {
+		t.Errorf("Init of known device with admin token: expected 200, got %d", code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	registry := newMetricsRegistry()
+	registry.request("/log", "POST", 200)
+	registry.request("/log", "POST", 200)
+	registry.ingest(ingestSourceMQTT, 5)
+	registry.dbError("insert")
+	registry.observeFlush(30 * time.Millisecond)
+	var out bytes.Buffer
+	if err := registry.write(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE iotedge_http_requests_total counter",
+		`iotedge_http_requests_total{route="/log",method="POST",status="200"} 2`,
+		`iotedge_ingested_points_total{source="mqtt"} 5`,
+		`iotedge_db_errors_total{operation="insert"} 1`,
+		`iotedge_flush_duration_seconds_bucket{le="0.025"} 0`,
+		`iotedge_flush_duration_seconds_bucket{le="0.05"} 1`,
+		`iotedge_flush_duration_seconds_bucket{le="+Inf"} 1`,
+		"iotedge_flush_duration_seconds_count 1",
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(line+"\n")) {
+			t.Errorf("Missing %q in:\n%s", line, out.String())
+		}
+	}
+	if labels := formatLabels([]string{"route", "a\"b\\c"}); labels != `{route="a\"b\\c"}` {
+		t.Errorf("Wrong escaping: %s", labels)
+	}
+
+	// requests are counted by the middleware of the HTTP server
+	iot := New(GetConfig())
+	router := gin.New()
+	router.Use(metricsMiddleware)
+	router.GET(URIMetrics, iot.Metrics)
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, URIMetrics, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+			t.Fatalf("Unexpected response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		return rec.Body.String()
+	}
+	scrape()
+	if body := scrape(); !bytes.Contains([]byte(body), []byte(`iotedge_http_requests_total{route="/metrics",method="GET",status="200"}`)) {
+		t.Errorf("Request not counted:\n%s", body)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	mqttPort, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := GetConfig()
+	config.MQTTPort = mqttPort.Addr().(*net.TCPAddr).Port
+	iot := New(config)
+	router := gin.New()
+	router.GET(URIHealth, iot.Health)
+	router.GET(URIReady, iot.Ready)
+	get := func(uri string) (int, HealthStatus) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, uri, nil))
+		var status HealthStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatalf("Invalid answer %s: %v", rec.Body.String(), err)
+		}
+		return rec.Code, status
+	}
+
+	if code, status := get(URIHealth); code != http.StatusOK || status.Status != HealthOK {
+		t.Errorf("Unexpected health %d %+v", code, status)
+	}
+	code, status := get(URIReady)
+	if code != http.StatusOK || status.Status != HealthReady || len(status.Checks) != 3 {
+		t.Errorf("Unexpected readiness %d %+v", code, status)
+	}
+
+	mqttPort.Close()
+	code, status = get(URIReady)
+	if code != http.StatusServiceUnavailable || status.Status != HealthUnavailable {
+		t.Errorf("Expected unavailable without broker, got %d %+v", code, status)
+	}
+	for _, check := range status.Checks {
+		if (check.Name == "mqtt") != (check.Status == HealthFailed) {
+			t.Errorf("Unexpected check result %+v", check)
+		}
+	}
+
+	iot.IoTConfig.MQTTPort = 0
+	if check := iot.checkBroker(); check.Status != HealthOK {
+		t.Errorf("Expected no broker check without MQTTPort, got %+v", check)
+	}
+
+	broker := NewMQTTEdge(config.MQTTPort, config)
+	now := time.Now()
+	broker.lastFlush.Store(now.Add(-time.Second).UnixNano())
+	if check := iot.checkFlush(broker, now); check.Status != HealthOK {
+		t.Errorf("Recent flush reported as %+v", check)
+	}
+	broker.lastFlush.Store(now.Add(-4 * time.Duration(config.UploadInterval) * time.Second).UnixNano())
+	if check := iot.checkFlush(broker, now); check.Status != HealthFailed {
+		t.Errorf("Stale flush reported as %+v", check)
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	config := GetConfig()
+	iot := New(config)
+	prefix := "LogQuery" + uuid.NewString()
+	for i, level := range []Loglevel{Debug, Info, Warning, Error} {
+		msg := LogMessage{Device: fmt.Sprintf("%s-%d", prefix, i), Text: "Needle " + prefix + " " + level.String(), Level: level}
+		if err := iot.LogMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := gin.New()
+	router.GET(URILogs, iot.GetLogs)
+	get := func(query string, status int) LogMessagesResponse {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, URILogs+"?"+query, nil))
+		if rec.Code != status {
+			t.Fatalf("Expected %d for %s, got %d: %s", status, query, rec.Code, rec.Body.String())
+		}
+		var resp LogMessagesResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	search := "q=needle+" + prefix
+	if resp := get(search, http.StatusOK); len(resp.Messages) != 4 || resp.NextOffset != 0 {
+		t.Errorf("Expected 4 messages, got %+v", resp)
+	}
+	resp := get(search+"&level=warning", http.StatusOK)
+	if len(resp.Messages) != 2 || resp.Messages[0].Level != Error || resp.Messages[0].Timestamp.IsZero() {
+		t.Errorf("Expected newest warning and error with timestamp, got %+v", resp)
+	}
+	resp = get("device="+prefix+"-1", http.StatusOK)
+	if len(resp.Messages) != 1 || resp.Messages[0].Level != Info {
+		t.Errorf("Expected the info message of the device, got %+v", resp)
+	}
+	first := get(search+"&limit=3&order=asc", http.StatusOK)
+	if len(first.Messages) != 3 || first.NextOffset != 3 {
+		t.Fatalf("Expected full first page, got %+v", first)
+	}
+	if next := get(search+"&limit=3&order=asc&offset=3", http.StatusOK); len(next.Messages) != 1 || next.Messages[0].Level != Error {
+		t.Errorf("Expected the error message on the second page, got %+v", next)
+	}
+	if resp := get(search+"&start="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339), http.StatusOK); len(resp.Messages) != 0 {
+		t.Errorf("Expected no future messages, got %+v", resp)
+	}
+	get("level=loud", http.StatusBadRequest)
+	get("limit=0", http.StatusBadRequest)
+}
+
+func TestLogBurst(t *testing.T) {
+	config := GetConfig()
+	iot := New(config)
+	router := gin.New()
+	router.POST(URILogging, iot.Log)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	device := "LogBurst" + uuid.NewString()
+	post := func(body any) {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp, err := http.Post(server.URL+URILogging, "application/json", bytes.NewBuffer(jsonData))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status %d", resp.StatusCode)
+		}
+	}
+
+	// many messages of one device within the same second
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			post(LogMessage{Device: device, Text: fmt.Sprintf("burst %d", i), Level: Info})
+		}()
+	}
+	deviceTime := time.Date(2024, 5, 1, 12, 0, 0, 123_000_000, time.UTC)
+	var batch []LogMessage
+	for i := range 50 {
+		batch = append(batch, LogMessage{Timestamp: deviceTime, Device: device, Text: fmt.Sprintf("batch %d", i), Level: Warning})
+	}
+	post(batch)
+	wg.Wait()
+
+	messages, err := GetLoggingDB(config.DbConfig).QueryLogMessages(LogQuery{Device: device, Limit: maxLogLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 150 {
+		t.Fatalf("Expected 150 stored messages, got %d", len(messages))
+	}
+	ids := map[int64]bool{}
+	for _, msg := range messages {
+		ids[msg.ID] = true
+	}
+	if len(ids) != 150 {
+		t.Errorf("Expected 150 distinct IDs, got %d", len(ids))
+	}
+	oldest := messages[len(messages)-1]
+	if !oldest.Timestamp.Equal(deviceTime) || oldest.Level != Warning {
+		t.Errorf("Expected device timestamp %v, got %+v", deviceTime, oldest)
+	}
+
+	for _, timestamp := range []time.Time{time.Now().Add(2 * maxLogClockSkew), time.Unix(10, 0)} {
+		jsonData, _ := json.Marshal(LogMessage{Timestamp: timestamp, Device: device, Text: "wrong clock"})
+		resp, err := http.Post(server.URL+URILogging, "application/json", bytes.NewBuffer(jsonData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected timestamp %v to be refused, got %d", timestamp, resp.StatusCode)
+		}
+	}
+}
+
+func TestLogsTableMigration(t *testing.T) {
+	config := timeseries.DBConfig{Name: "old-logs.db", IPOrPath: t.TempDir()}
+	db := timeseries.DBHandler(config)
+	defer db.Close()
+	for _, sqlStr := range []string{
+		`CREATE TABLE logs (
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			device TEXT NOT NULL,
+			text TEXT DEFAULT '',
+			level INTEGER DEFAULT 2,
+			PRIMARY KEY (timestamp, device))`,
+		`INSERT INTO logs (timestamp, device, text, level) VALUES ('2024-05-01 12:00:00', 'Old', 'before', 1)`,
+	} {
+		if _, err := db.ExecuteQuery(sqlStr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logs := &LoggingDB{DbHandler: db, conf: config, batch: &logBatch{}}
+	if err := logs.migrateLogsTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := logs.createLogsTable(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := logs.InsertLogMessages([]LogMessage{
+		{Timestamp: now, Device: "Old", Text: "first"},
+		{Timestamp: now, Device: "Old", Text: "second"},
+	}); err != nil {
+		t.Fatalf("Messages within the same second must be stored: %v", err)
+	}
+	messages, err := logs.QueryLogMessages(LogQuery{Device: "Old", Ascending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 || messages[0].Text != "before" || messages[0].ID == 0 ||
+		!messages[0].Timestamp.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected messages after migration %+v", messages)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	config := GetConfig()
+	iot := New(config)
+	table := "retentiontest"
+	if err := iot.DeviceDB.CreateTimeseriesTable(table); err != nil {
+		t.Fatal(err)
+	}
+	prefix := "Retention" + uuid.NewString()
+	now := time.Now()
+	var data []timeseries.TimeseriesImportStruct
+	for _, tag := range []string{prefix + "AKeep", prefix + "BKeep", prefix + "C"} {
+		ts := timeseries.TimeseriesImportStruct{Tag: tag}
+		for _, days := range []int{1, 10, 100} {
+			ts.Timestamps = append(ts.Timestamps, now.Add(-time.Duration(days)*24*time.Hour).UTC().Format(TimestampFormat))
+			ts.Values = append(ts.Values, "1")
+		}
+		data = append(data, ts)
+	}
+	if err := iot.DeviceDB.InsertTimeseriesBatch(data, table); err != nil {
+		t.Fatal(err)
+	}
+	policies := []RetentionPolicy{
+		{Table: table, MaxAge: "5d"},
+		{Table: table, Tag: prefix + "A*", MaxAge: "50d"},
+		{Table: table, Tag: prefix + "*Keep", MaxAge: "1000d"},
+	}
+	rowCounts := func(results []PruneResult) []int64 {
+		var counts []int64
+		for _, r := range results {
+			counts = append(counts, r.Rows)
+		}
+		return counts
+	}
+	results, err := iot.DeviceDB.Prune(table, policies, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// C loses 10 and 100 days, AKeep 100 days, BKeep nothing
+	if counts := rowCounts(results); !slices.Equal(counts, []int64{2, 1, 0}) {
+		t.Errorf("Expected 2, 1 and 0 rows to prune, got %v", counts)
+	}
+	if results, err = iot.DeviceDB.Prune(table, policies, now, false); err != nil {
+		t.Fatal(err)
+	}
+	if counts := rowCounts(results); !slices.Equal(counts, []int64{2, 1, 0}) {
+		t.Errorf("Expected 2, 1 and 0 rows to be deleted, got %v", counts)
+	}
+	results, _ = iot.DeviceDB.Prune(table, policies, now, true)
+	if counts := rowCounts(results); !slices.Equal(counts, []int64{0, 0, 0}) {
+		t.Errorf("Expected nothing left to prune, got %v", counts)
+	}
+	rows, err := iot.DeviceDB.QueryTimeseries(table, TimeseriesQuery{Tags: []string{prefix + "*"}, Start: now.Add(-1000 * 24 * time.Hour), End: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 {
+		t.Errorf("Expected 6 rows to be kept, got %d", len(rows))
+	}
+
+	for _, other := range []string{"logs; DROP", "devices", "sensors"} {
+		if _, err := iot.DeviceDB.Prune(table, []RetentionPolicy{{Table: other, MaxAge: "1d"}}, now, true); err == nil {
+			t.Errorf("Expected table %s to be refused", other)
+		}
+	}
+	if err := ValidateRetention([]RetentionPolicy{{Table: RollupTable(table, "daily"), MaxAge: "1d"}}, table); err != nil {
+		t.Errorf("Expected rollup table to be accepted: %v", err)
+	}
+	if _, err := iot.DeviceDB.Prune(table, []RetentionPolicy{{Table: "logs", MaxAge: "-1d"}}, now, true); err == nil {
+		t.Error("Expected invalid max age to be refused")
+	}
+
+	exited := false
+	log.StandardLogger().ExitFunc = func(int) { exited = true }
+	defer func() { log.StandardLogger().ExitFunc = nil }()
+	config.Retention = []RetentionPolicy{{Table: "devices", MaxAge: "1d"}}
+	New(config)
+	if !exited {
+		t.Error("Expected invalid retention to stop the server")
+	}
+}
+
+func TestRollups(t *testing.T) {
+	config := GetConfig()
+	iot := New(config)
+	table := "rolluptest"
+	if err := iot.DeviceDB.CreateTimeseriesTable(table); err != nil {
+		t.Fatal(err)
+	}
+	if err := iot.DeviceDB.EnableRollups(table, []string{"hourly", "daily"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := iot.DeviceDB.EnableRollups(table, []string{"weekly"}); err == nil {
+		t.Error("Expected unknown rollup to be refused")
+	}
+	tag := "Rollup" + uuid.NewString()
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	batch := func(minutes []int, values []string) []timeseries.TimeseriesImportStruct {
+		ts := timeseries.TimeseriesImportStruct{Tag: tag, Values: values}
+		for _, m := range minutes {
+			ts.Timestamps = append(ts.Timestamps, day.Add(time.Duration(m)*time.Minute).Format(TimestampFormat))
+		}
+		return []timeseries.TimeseriesImportStruct{ts}
+	}
+	first := batch([]int{10, 20, 70}, []string{"1", "3", "10"})
+	for _, data := range [][]timeseries.TimeseriesImportStruct{
+		first,
+		first, // repeated batches must not be counted twice
+		batch([]int{30, 80}, []string{"5", "20"}),
+	} {
+		if err := iot.DeviceDB.InsertTimeseriesBatch(data, table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type bucket struct {
+		Min, Max, Avg float64
+		Count         int64
+	}
+	read := func(rollupTable string) []bucket {
+		rows, err := iot.DeviceDB.ExecuteQuery("SELECT min, max, avg, count FROM "+rollupTable+" WHERE tag = ? ORDER BY time", tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var buckets []bucket
+		for rows.Next() {
+			var b bucket
+			if err := rows.Scan(&b.Min, &b.Max, &b.Avg, &b.Count); err != nil {
+				t.Fatal(err)
+			}
+			buckets = append(buckets, b)
+		}
+		return buckets
+	}
+	hourly := []bucket{{1, 5, 3, 3}, {10, 20, 15, 2}}
+	daily := []bucket{{1, 20, 7.8, 5}}
+	if got := read(RollupTable(table, "hourly")); !slices.Equal(got, hourly) {
+		t.Errorf("Expected hourly %v, got %v", hourly, got)
+	}
+	if got := read(RollupTable(table, "daily")); !slices.Equal(got, daily) {
+		t.Errorf("Expected daily %v, got %v", daily, got)
+	}
+
+	rows, err := iot.DeviceDB.ExecuteQuery("DELETE FROM "+RollupTable(table, "hourly")+" WHERE tag = ?", tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if _, err := iot.DeviceDB.BackfillRollups(table, day); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(RollupTable(table, "hourly")); !slices.Equal(got, hourly) {
+		t.Errorf("Expected backfilled hourly %v, got %v", hourly, got)
+	}
+	if got := read(RollupTable(table, "daily")); !slices.Equal(got, daily) {
+		t.Errorf("Expected backfilled daily %v, got %v", daily, got)
+	}
+
+	// a failed rollup update doesn't keep the raw rows either
+	rows, err = iot.DeviceDB.ExecuteQuery("DROP TABLE " + RollupTable(table, "daily"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if err := iot.DeviceDB.InsertTimeseriesBatch(batch([]int{90}, []string{"7"}), table); err == nil {
+		t.Error("Expected insert to fail without rollup table")
+	}
+	stored, err := iot.DeviceDB.countRows(table, "tag = ?", []interface{}{tag})
+	if err != nil || stored != 5 {
+		t.Errorf("Expected the 5 rows of before, got %d: %v", stored, err)
+	}
+	if err := iot.DeviceDB.EnableRollups(table, []string{"hourly", "daily"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := iot.DeviceDB.InsertTimeseriesBatch(batch([]int{90}, []string{"7"}), table); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(RollupTable(table, "hourly")); len(got) != 2 || got[1].Count != 3 {
+		t.Errorf("Expected the retried value in the hourly rollup, got %v", got)
+	}
+}
+
+func TestExport(t *testing.T) {
+	config := GetConfig()
+	iot := New(config)
+	tag := "Export" + uuid.NewString()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	data := []timeseries.TimeseriesImportStruct{{
+		Tag:        tag,
+		Timestamps: []string{"2024-03-01 12:00:00.000", "2024-03-01 12:00:01.500", "2024-03-01 12:00:02.000"},
+		Values:     []string{"1.5", "2", "-3"},
+		Comments:   []string{"", "reboot, then \"ok\"", ""},
+	}}
+	if err := iot.DeviceDB.InsertTimeseriesBatch(data, config.TimeseriesTable); err != nil {
+		t.Fatal(err)
+	}
+	q := TimeseriesQuery{Tags: []string{tag}, Start: start, End: start.Add(time.Minute)}
+	export := func(format string) string {
+		var buf bytes.Buffer
+		count, err := iot.DeviceDB.ExportTimeseries(&buf, config.TimeseriesTable, q, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 3 {
+			t.Errorf("Expected 3 %s rows, got %d", format, count)
+		}
+		return buf.String()
+	}
+
+	records, err := csv.NewReader(strings.NewReader(export(ExportCSV))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[2][0] != "2024-03-01T12:00:01.5Z" || records[2][2] != "2" || records[2][3] != "reboot, then \"ok\"" {
+		t.Errorf("Unexpected CSV %v", records)
+	}
+
+	lines := strings.Split(strings.TrimSpace(export(ExportJSONLines)), "\n")
+	var row TimeseriesRow
+	if len(lines) != 3 || json.Unmarshal([]byte(lines[2]), &row) != nil || row.Value != -3 || !row.Time.Equal(start.Add(2*time.Second)) {
+		t.Errorf("Unexpected JSON Lines %v", lines)
+	}
+
+	var imported []timeseries.TimeseriesImportStruct
+	if err := json.Unmarshal([]byte(export(ExportTimeseries)), &imported); err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 1 || !slices.Equal(imported[0].Timestamps, data[0].Timestamps) || !slices.Equal(imported[0].Comments, data[0].Comments) {
+		t.Errorf("Expected the inserted data, got %+v", imported)
+	}
+
+	router := gin.New()
+	router.GET(URIExportTimeseries, iot.Export)
+	get := func(query string, status int) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, URIExportTimeseries+"?"+query, nil))
+		if rec.Code != status {
+			t.Fatalf("Expected %d for %s, got %d: %s", status, query, rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+	get("tag="+tag+"&format=xml", http.StatusBadRequest)
+	rec := get("tag="+tag+"&start=2024-03-01T12:00:00Z&end=2024-03-01T13:00:00Z&format=jsonl", http.StatusOK)
+	if rec.Header().Get("Content-Type") != "application/x-ndjson" || strings.Count(rec.Body.String(), "\n") != 3 {
+		t.Errorf("Unexpected export %s: %s", rec.Header(), rec.Body.String())
+	}
+
+	// round trip of a sensor with offset
+	name := "Export" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	dev, err := iot.DeviceDB.GetOrCreateDevice(DeviceDesc{Name: name, Sensors: []string{"Temperature"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensor := Sensor{DeviceID: dev.ID, Name: name + "Temperature", SensorOffset: -0.5}
+	if err := iot.DeviceDB.InsertSensor(sensor); err != nil {
+		t.Fatal(err)
+	}
+	if err := iot.DeviceDB.ConfigureSensor(sensor); err != nil {
+		t.Fatal(err)
+	}
+	router.POST(URISaveTimeseries, iot.SaveTimeseries)
+	save := func(query string, body []byte) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, URISaveTimeseries+query, bytes.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d: %s", query, rec.Code, rec.Body.String())
+		}
+	}
+	body, _ := json.Marshal([]timeseries.TimeseriesImportStruct{{Tag: name + "Temperature",
+		Timestamps: []string{"2024-03-01 12:00:00.000"}, Values: []string{"20"}}})
+	save("", body)
+	q.Tags = []string{name + "Temperature"}
+	var exported bytes.Buffer
+	if _, err := iot.DeviceDB.ExportTimeseries(&exported, config.TimeseriesTable, q, ExportTimeseries); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := iot.DeviceDB.ExecuteQuery("DELETE FROM "+config.TimeseriesTable+" WHERE tag = ?", name+"Temperature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	save("?offsets="+OffsetsApplied, exported.Bytes())
+	stored, err := iot.DeviceDB.QueryTimeseries(config.TimeseriesTable, q)
+	if err != nil || len(stored) != 1 || stored[0].Value != 19.5 || stored[0].Comment != RawValueCommentPrefix+"20" {
+		t.Errorf("Expected the exported value with offset once, got %+v: %v", stored, err)
+	}
+
+	// no rounding to six digits and no float32 noise of the offset
+	sensor.SensorOffset = 0.1
+	if err := iot.DeviceDB.ConfigureSensor(sensor); err != nil {
+		t.Fatal(err)
+	}
+	applied := iot.DeviceDB.ApplySensorOffset(timeseries.TimeseriesImportStruct{Tag: sensor.Name,
+		Timestamps: []string{"2024-03-01 12:00:00.000", "2024-03-01 13:00:00.000"}, Values: []string{"20", "1.23456789"}})
+	if !slices.Equal(applied.Values, []string{"20.1", "1.33456789"}) {
+		t.Errorf("Expected 20.1 and 1.33456789, got %v", applied.Values)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	config := GetConfig()
+	iot := New(config)
+	table := "importtest"
+	if err := iot.DeviceDB.CreateTimeseriesTable(table); err != nil {
+		t.Fatal(err)
+	}
+	prefix := "Import" + uuid.NewString()
+	file := "Datum;Temp;Hum\n" +
+		"01.03.2024 12:00;21,5;40\n" +
+		"01.03.2024 13:00;22;\n" +
+		"01.03.2024 13:00;23;41\n" + // repeated timestamp
+		"01.03.2024 14:00;n/a;42\n"
+	opts := CSVImportOptions{
+		Delimiter:  ';',
+		TimeColumn: "Datum",
+		TimeFormat: "02.01.2006 15:04",
+		Location:   time.FixedZone("CET", 3600),
+		TagPrefix:  prefix,
+		DryRun:     true,
+	}
+	stats, err := iot.DeviceDB.ImportCSV(strings.NewReader(file), table, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Lines != 4 || stats.Values != 6 || stats.Empty != 1 || stats.Invalid != 1 || stats.Written != 0 ||
+		stats.Tags[prefix+"Temp"] != 3 || !stats.First.Equal(time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected dry run %+v", stats)
+	}
+	query := func(tag string) []float64 {
+		rows, err := iot.DeviceDB.QueryTimeseries(table, TimeseriesQuery{Tags: []string{prefix + tag},
+			Start: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []float64
+		for _, row := range rows {
+			values = append(values, row.Value)
+		}
+		return values
+	}
+	if values := query("*"); len(values) != 0 {
+		t.Fatalf("Expected nothing written on dry run, got %v", values)
+	}
+
+	opts.DryRun = false
+	var progress int
+	opts.Progress = func(CSVImportStats) { progress++ }
+	if stats, err = iot.DeviceDB.ImportCSV(strings.NewReader(file), table, opts); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 5 || stats.Duplicates() != 1 || progress == 0 {
+		t.Errorf("Expected 5 values written and 1 duplicate, got %+v", stats)
+	}
+	if values := query("Temp"); !slices.Equal(values, []float64{21.5, 22}) {
+		t.Errorf("Expected the first value of the repeated timestamp, got %v", values)
+	}
+	if stats, _ = iot.DeviceDB.ImportCSV(strings.NewReader(file), table, opts); stats.Written != 0 || stats.Duplicates() != 6 {
+		t.Errorf("Expected all values to be skipped on the second import, got %+v", stats)
+	}
+	opts.Replace = true
+	if stats, _ = iot.DeviceDB.ImportCSV(strings.NewReader(file), table, opts); stats.Written != 5 {
+		t.Errorf("Expected 5 values replaced, got %+v", stats)
+	}
+	if values := query("Temp"); !slices.Equal(values, []float64{21.5, 23}) {
+		t.Errorf("Expected the last value of the repeated timestamp, got %v", values)
+	}
+
+	if _, err := iot.DeviceDB.ImportCSV(strings.NewReader("time,Temp\nyesterday,1\n"), table, CSVImportOptions{}); err == nil ||
+		!strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected error for line 2, got %v", err)
+	}
+}
+
+func TestParseLineProtocol(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	body := `# comment
+cpu,host=edge1,region=eu\ west usage_idle=92.5,usage_user=3i,up=true,note="a \"quoted\", text" 1714564770000000000
+weather\,station,host=edge1 temp=-1.5e1 1714564771000000000
+
+cpu,host=edge2 usage_idle=50u
+`
+	data, err := parseLineProtocol(strings.NewReader(body), "{host}{measurement}_{field}", time.Nanosecond, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []timeseries.TimeseriesImportStruct{
+		{Tag: "edge1cpu_usage_idle", Timestamps: []string{"2024-05-01 11:59:30.000"}, Values: []string{"92.5"}},
+		{Tag: "edge1cpu_usage_user", Timestamps: []string{"2024-05-01 11:59:30.000"}, Values: []string{"3"}},
+		{Tag: "edge1cpu_up", Timestamps: []string{"2024-05-01 11:59:30.000"}, Values: []string{"1"}},
+		{Tag: "edge1weather,station_temp", Timestamps: []string{"2024-05-01 11:59:31.000"}, Values: []string{"-15"}},
+		{Tag: "edge2cpu_usage_idle", Timestamps: []string{"2024-05-01 12:00:00.000"}, Values: []string{"50"}},
+	}
+	if fmt.Sprint(data) != fmt.Sprint(expected) {
+		t.Errorf("Expected %+v, got %+v", expected, data)
+	}
+
+	data, err = parseLineProtocol(strings.NewReader("Basel3 Temperature=21.5 1714564770"), defaultLineProtocolTag, time.Second, now)
+	if err != nil || len(data) != 1 || data[0].Tag != "Basel3Temperature" || data[0].Timestamps[0] != "2024-05-01 11:59:30.000" {
+		t.Errorf("Unexpected default naming %+v: %v", data, err)
+	}
+
+	for _, invalid := range []string{"cpu", "cpu usage", "cpu,host usage=1", "cpu usage=abc", "cpu usage=NaN",
+		`cpu note="open`, "cpu usage=1 yesterday", "cpu usage=1.5i"} {
+		if _, err := parseLineProtocol(strings.NewReader("cpu ok=1\n"+invalid), defaultLineProtocolTag, time.Nanosecond, now); err == nil ||
+			!strings.Contains(err.Error(), "line 2") {
+			t.Errorf("Expected error in line 2 for %s, got %v", invalid, err)
+		}
+	}
+	if _, err := parseLineProtocol(strings.NewReader("cpu usage=1 9223372036854775807"), defaultLineProtocolTag, time.Second, now); err == nil {
+		t.Error("Expected timestamp out of range to be refused")
+	}
+}
+
+func TestWriteLineProtocol(t *testing.T) {
+	config := GetConfig()
+	iot := New(config)
+	iot.IoTConfig.LineProtocolTag = "{measurement}{field}"
+	router := gin.New()
+	router.POST(URIWrite, iot.WriteLineProtocol)
+	measurement := "Influx" + strings.ReplaceAll(uuid.NewString(), "-", "")
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	fmt.Fprintf(gz, "%s Temperature=21.5,Humidity=40i 1714564770000\n%s Temperature=22 1714564771000\n", measurement, measurement)
+	gz.Close()
+	req := httptest.NewRequest(http.MethodPost, URIWrite+"?db=edge&precision=ms", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rows, err := iot.DeviceDB.QueryTimeseries(config.TimeseriesTable, TimeseriesQuery{Tags: []string{measurement + "*"},
+		Start: time.UnixMilli(1714564770000), End: time.UnixMilli(1714564772000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].Tag != measurement+"Humidity" || rows[2].Value != 22 {
+		t.Errorf("Expected the written values, got %+v", rows)
+	}
+
+	for query, lines := range map[string]string{"": measurement + " Temperature=", "?precision=days": measurement + " T=1"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, URIWrite+query, strings.NewReader(lines)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s%s, got %d", query, lines, rec.Code)
+		}
+	}
+
+	// the limit applies to the decompressed body as well
+	body.Reset()
+	gz = gzip.NewWriter(&body)
+	gz.Write(bytes.Repeat([]byte("\n"), maxLineProtocolBody+1))
+	gz.Close()
+	req = httptest.NewRequest(http.MethodPost, URIWrite, &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a large body, got %d", rec.Code)
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	config := GetConfig()
+	iot := New(config)
+	router := gin.New()
+	router.POST(URIRemoteWrite, iot.RemoteWrite)
+	instance := "edge-" + uuid.NewString()
+	timestamp := time.Date(2024, 5, 1, 11, 59, 30, 0, time.UTC)
+
+	appendMessage := func(b []byte, num protowire.Number, message []byte) []byte {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, message)
+	}
+	series := func(labels map[string]string, values ...float64) []byte {
+		var b []byte
+		for _, name := range slices.Sorted(maps.Keys(labels)) {
+			var label []byte
+			label = appendMessage(label, 1, []byte(name))
+			label = appendMessage(label, 2, []byte(labels[name]))
+			b = appendMessage(b, 1, label)
+		}
+		for i, v := range values {
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(v))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(timestamp.Add(time.Duration(i)*time.Second).UnixMilli()))
+			b = appendMessage(b, 2, sample)
+		}
+		return b
+	}
+	var request []byte
+	request = appendMessage(request, 1, series(map[string]string{"__name__": "node_load1", "instance": instance, "job": "node"}, 0.5, 0.75))
+	request = appendMessage(request, 1, series(map[string]string{"__name__": "up", "instance": instance}, 1, math.NaN()))
+
+	post := func(body []byte, contentType string) int {
+		req := httptest.NewRequest(http.MethodPost, URIRemoteWrite, bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := post(snappy.Encode(nil, request), "application/x-protobuf"); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	rows, err := iot.DeviceDB.QueryTimeseries(config.TimeseriesTable, TimeseriesQuery{Tags: []string{"*" + instance + "*"},
+		Start: timestamp, End: timestamp.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadTag := `node_load1{instance="` + instance + `",job="node"}`
+	if len(rows) != 3 || rows[0].Tag != loadTag || rows[1].Value != 0.75 || rows[2].Tag != `up{instance="`+instance+`"}` {
+		t.Errorf("Expected two load samples and one up sample, got %+v", rows)
+	}
+
+	if tag := promSeriesTag("{instance}_{__name__}", promSeries{labels: []promLabel{{"__name__", "up"}, {"instance", "edge1"}}}); tag != "edge1_up" {
+		t.Errorf("Unexpected tag %s", tag)
+	}
+	if code := post(request, "application/x-protobuf"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for uncompressed body, got %d", code)
+	}
+	if code := post(snappy.Encode(nil, []byte{0x0a, 0xff}), "application/x-protobuf"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for truncated protobuf, got %d", code)
+	}
+	if code := post(snappy.Encode(nil, request), "application/x-protobuf;proto=io.prometheus.write.v2.Request"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for remote write 2.0, got %d", code)
+	}
+}
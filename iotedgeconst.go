@@ -1,20 +1,43 @@
 package iotedge
 
+import "time"
+
 type IoTEdge struct {
 	Port      int
 	IoTConfig IoTConfig
 	DeviceDB  *DeviceDB
+	Alerts    *AlertEngine
 }
 
 const (
-	HTTPPort           int    = 3004
-	URIInitDevice      string = "/init-device"
-	URIUpdateSensor    string = "/update-sensor"
-	URIDeviceConfigure string = "/device/configure"
-	URISensorConfigure string = "/sensor/configure"
-	URIUploadData      string = "/upload-data"
-	URISaveTimeseries  string = "/timeseries/save"
-	URILogging         string = "/log"
+	HTTPPort            int    = 3004
+	URIInitDevice       string = "/init-device"
+	URIUpdateSensor     string = "/update-sensor"
+	URIDeviceConfigure  string = "/device/configure"
+	URISensorConfigure  string = "/sensor/configure"
+	URIUploadData       string = "/upload-data"
+	URISaveTimeseries   string = "/timeseries/save"
+	URILogging          string = "/log"
+	URIQueryTimeseries  string = "/timeseries/query"
+	URIExportTimeseries string = "/timeseries/export"
+	URIDevices          string = "/devices"
+	URIDevice           string = "/devices/:name"
+	URIDeviceSensors    string = "/devices/:name/sensors"
+	URIDeviceSensor     string = "/devices/:name/sensors/:sensor"
+	URIDeviceStatus     string = "/status"
+	URIAlerts           string = "/alerts"
+	URIAlertRules       string = "/alerts/rules"
+	URIAlertRule        string = "/alerts/rules/:id"
+	URIMetrics          string = "/metrics"
+	URILogs             string = "/logs"
+	URIHealth           string = "/healthz"
+	URIReady            string = "/readyz"
+	URIWrite            string = "/write"
+	URIWriteV2          string = "/api/v2/write"
+	URIRemoteWrite      string = "/api/v1/write"
+
+	TimestampFormat       string = "2006-01-02 15:04:05.000"
+	RawValueCommentPrefix string = "raw="
 )
 
 type Output struct {
@@ -56,6 +79,50 @@ type Device struct {
 	Interval    float32
 	Buffer      int
 	Description string
+	LastSeen    *time.Time `json:",omitempty"`
+	// ConfigVersion is increased with every configuration change, devices
+	// report the version they applied as AppliedConfigVersion.
+	ConfigVersion        int
+	AppliedConfigVersion int
+}
+
+// DeviceConfig is published retained on devices/<name>/config.
+type DeviceConfig struct {
+	Version       int
+	Interval      float32
+	Buffer        int
+	SensorOffsets map[string]float32
+}
+
+type InitDeviceResponse struct {
+	Device
+	Token string `json:",omitempty"`
+}
+
+type DeviceStatus struct {
+	Name                 string
+	LastSeen             *time.Time
+	State                string
+	ConfigVersion        int
+	AppliedConfigVersion int
+}
+
+// LogMessagesResponse is a page of log messages. NextOffset is set if there
+// may be more messages.
+type LogMessagesResponse struct {
+	Messages   []LogMessage
+	NextOffset int `json:",omitempty"`
+}
+
+type HealthCheck struct {
+	Name    string
+	Status  string
+	Message string `json:",omitempty"`
+}
+
+type HealthStatus struct {
+	Status string
+	Checks []HealthCheck `json:",omitempty"`
 }
 
 type ConfigureSensorReq struct {
@@ -69,3 +136,28 @@ type ConfigureDeviceReq struct {
 	Interval float32
 	Buffer   int
 }
+
+type UpdateDeviceReq struct {
+	Description *string
+	Interval    *float32
+	Buffer      *int
+}
+
+type UpdateSensorReq struct {
+	SensorOffset *float32
+}
+
+type TimeseriesQuery struct {
+	Tags      []string
+	Start     time.Time
+	End       time.Time
+	Bucket    time.Duration
+	Aggregate string
+}
+
+type TimeseriesRow struct {
+	Time    time.Time `json:"Time"`
+	Tag     string    `json:"Tag"`
+	Value   float64   `json:"Value"`
+	Comment string    `json:"Comment,omitempty"`
+}
@@ -1,8 +1,13 @@
 package iotedge
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -23,20 +28,53 @@ func (s *IoTEdge) SaveTimeseries(c *gin.Context) {
 
 	log.Infof("Received data.%+v", data)
 	log.Tracef("%+v", data)
+	if !s.mayWriteTags(c, importTags(data)) {
+		return
+	}
 
-	for _, ts := range data {
+	// data exported with format=timeseries carries the offsets already
+	applyOffsets := c.Query("offsets") != OffsetsApplied
+	for i, ts := range data {
 		log.Infof("insert %v", ts.Tag)
-		if err := s.DeviceDB.InsertTimeseries(ts, true, s.IoTConfig.TimeseriesTable); err != nil {
-			log.WithFields(logFields).Errorf("Failed to save timeseries: %+v ", err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save timeseries: %v", err)})
-			return
-		}
+		data[i] = s.prepareTimeseries(ts, applyOffsets)
+	}
+	if err := s.DeviceDB.InsertTimeseriesBatch(data, s.IoTConfig.TimeseriesTable); err != nil {
+		log.WithFields(logFields).Errorf("Failed to save timeseries: %+v ", err.Error())
+		c.JSON(insertErrorStatus(err), gin.H{"error": fmt.Sprintf("Failed to save timeseries: %v", err)})
+		return
 	}
+	s.evaluateAlerts(data)
 
 	c.Header("Access-Control-Allow-Origin", "*")
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
+func importTags(data []timeseries.TimeseriesImportStruct) []string {
+	tags := make([]string, 0, len(data))
+	for _, ts := range data {
+		tags = append(tags, ts.Tag)
+	}
+	return tags
+}
+
+// prepareTimeseries runs the per tag ingest steps before the data is stored.
+func (s *IoTEdge) prepareTimeseries(ts timeseries.TimeseriesImportStruct, applyOffset bool) timeseries.TimeseriesImportStruct {
+	serverMetrics.ingest(ingestSourceHTTP, len(ts.Values))
+	s.DeviceDB.TouchTag(ts.Tag)
+	if applyOffset {
+		ts = s.DeviceDB.ApplySensorOffset(ts)
+	}
+	return ts
+}
+
+// evaluateAlerts runs the alert rules once the data is stored, refused data
+// must not raise alerts.
+func (s *IoTEdge) evaluateAlerts(data []timeseries.TimeseriesImportStruct) {
+	for _, ts := range data {
+		s.Alerts.EvaluateTimeseries(ts)
+	}
+}
+
 func (s *IoTEdge) UploadDataHandler(c *gin.Context) {
 	logFields := log.Fields{"fnct": "UploadDataHandler"}
 	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
@@ -60,14 +98,19 @@ func (s *IoTEdge) UploadDataHandler(c *gin.Context) {
 	}
 
 	log.WithFields(logFields).Infof("Value: %+v ", data)
+	if !s.mayWriteTags(c, importTags(data)) {
+		return
+	}
 
-	for _, val := range data {
-		if err := s.DeviceDB.InsertTimeseries(val, true, s.IoTConfig.TimeseriesTable); err != nil {
-			log.Errorf("Failed to insert values into database: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to insert values into database: %v", err)})
-			return
-		}
+	for i, val := range data {
+		data[i] = s.prepareTimeseries(val, true)
 	}
+	if err := s.DeviceDB.InsertTimeseriesBatch(data, s.IoTConfig.TimeseriesTable); err != nil {
+		log.Errorf("Failed to insert values into database: %v", err)
+		c.JSON(insertErrorStatus(err), gin.H{"error": fmt.Sprintf("Failed to insert values into database: %v", err)})
+		return
+	}
+	s.evaluateAlerts(data)
 
 	c.JSON(http.StatusOK, Output{Status: "OK", Answer: "Success"})
 }
@@ -89,7 +132,26 @@ func (s *IoTEdge) InitDevice(c *gin.Context) {
 	logFields["Description"] = deviceReq.DeviceDesc.Description
 	log.WithFields(logFields).Infof("Value: %+v", deviceReq)
 
+	allowed, err := s.mayInitDevice(c, deviceReq.DeviceDesc.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("checking token failed: %v", err)})
+		return
+	}
+	if !allowed {
+		log.WithFields(logFields).Warnf("init device %s without its token", deviceReq.DeviceDesc.Name)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "device token required"})
+		return
+	}
+
 	dev, err := s.Init(deviceReq.DeviceDesc)
+	if errors.Is(err, ErrReservedDeviceName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	if errors.Is(err, ErrSensorOfOtherDevice) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("init device %s failed: %v", deviceReq.DeviceDesc.Name, err)})
+		return
+	}
 	if err != nil {
 		log.WithFields(logFields).Warnf("init device %s failed: %v", deviceReq.DeviceDesc.Name, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("init device %s failed: %v", deviceReq.DeviceDesc.Name, err)})
@@ -97,8 +159,20 @@ func (s *IoTEdge) InitDevice(c *gin.Context) {
 	}
 
 	log.WithFields(logFields).Infof("device initialized: %+v", dev)
+	s.DeviceDB.TouchDevice(dev.ID)
+	resp := InitDeviceResponse{Device: dev}
+	if s.IoTConfig.HTTPAuth {
+		hasToken, err := s.DeviceDB.HasDeviceToken(dev.Name)
+		if err == nil && !hasToken {
+			resp.Token, err = s.DeviceDB.IssueDeviceToken(dev.Name)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("issuing token failed: %v", err)})
+			return
+		}
+	}
 	SetGinHeaders(c)
-	c.JSON(http.StatusOK, dev)
+	c.JSON(http.StatusOK, resp)
 }
 
 func (s *IoTEdge) ConfigureDevice(c *gin.Context) {
@@ -112,15 +186,14 @@ func (s *IoTEdge) ConfigureDevice(c *gin.Context) {
 	}
 
 	log.WithFields(logFields).Infof("Value: %+v", p)
-	dev, err := s.DeviceDB.GetDevice(p.Name)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getting device failed: %v", err)})
+	dev, ok := s.findDevice(c, p.Name)
+	if !ok {
 		return
 	}
 
 	dev.Interval = p.Interval
 	dev.Buffer = p.Buffer
-	if err = s.DeviceDB.Configure(dev); err != nil {
+	if err := s.DeviceDB.Configure(dev); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("configuring device failed: %v", err)})
 		return
 	}
@@ -140,9 +213,8 @@ func (s *IoTEdge) ConfSensor(c *gin.Context) {
 	}
 
 	log.WithFields(logFields).Infof("Value: %+v", p)
-	dev, err := s.DeviceDB.GetDevice(p.Name)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getting device failed: %v", err)})
+	dev, ok := s.findDevice(c, p.Name)
+	if !ok {
 		return
 	}
 
@@ -187,7 +259,15 @@ func (s *IoTEdge) UpdateSensorHandler(c *gin.Context) {
 	}
 
 	log.WithFields(logFields).Infof("Value: %+v", p)
+	tags := make([]string, 0, len(p.Data))
+	for _, val := range p.Data {
+		tags = append(tags, val.Name)
+	}
+	if !s.mayWriteTags(c, tags) {
+		return
+	}
 
+	var data []timeseries.TimeseriesImportStruct
 	for _, val := range p.Data {
 		tsVal := timeseries.TimeseriesImportStruct{
 			Tag:        val.Name,
@@ -195,13 +275,14 @@ func (s *IoTEdge) UpdateSensorHandler(c *gin.Context) {
 			Values:     []string{fmt.Sprintf("%f", val.Value)},
 			Comments:   p.Tags,
 		}
-
-		if err := s.DeviceDB.InsertTimeseries(tsVal, true, s.IoTConfig.TimeseriesTable); err != nil {
-			log.Errorf("Failed to insert values into database: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to insert values into database: %v", err)})
-			return
-		}
+		data = append(data, s.prepareTimeseries(tsVal, true))
 	}
+	if err := s.DeviceDB.InsertTimeseriesBatch(data, s.IoTConfig.TimeseriesTable); err != nil {
+		log.Errorf("Failed to insert values into database: %v", err)
+		c.JSON(insertErrorStatus(err), gin.H{"error": fmt.Sprintf("Failed to insert values into database: %v", err)})
+		return
+	}
+	s.evaluateAlerts(data)
 
 	SetGinHeaders(c)
 	c.JSON(http.StatusOK, Output{Status: "OK", Answer: "Success"})
@@ -211,21 +292,389 @@ func (s *IoTEdge) Log(c *gin.Context) {
 	logFields := log.Fields{"fnct": "Log"}
 	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
 
-	var logMsg LogMessage
-	if err := c.BindJSON(&logMsg); err != nil {
+	// a single message or an array of messages
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	var logMsgs []LogMessage
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &logMsgs)
+	} else {
+		var logMsg LogMessage
+		err = json.Unmarshal(trimmed, &logMsg)
+		logMsgs = append(logMsgs, logMsg)
+	}
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
 		return
 	}
+	now := time.Now()
+	for _, msg := range logMsgs {
+		if err := ValidateLogMessage(msg, now); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+			return
+		}
+	}
+	if !s.mayWriteLogs(c, logMsgs) {
+		return
+	}
 
-	log.WithFields(logFields).Infof("Value: %+v", logMsg)
+	log.WithFields(logFields).Infof("Got %d messages", len(logMsgs))
 	SetGinHeaders(c)
-	if err := s.LogMessage(logMsg); err != nil {
+	if err := s.LogMessages(logMsgs); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to log message: %v", err)})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"status": "success"})
 }
 
+func (s *IoTEdge) GetLogs(c *gin.Context) {
+	logFields := log.Fields{"fnct": "GetLogs"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	q, err := parseLogQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	messages, err := GetLoggingDB(s.IoTConfig.DbConfig).QueryLogMessages(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("query failed: %v", err)})
+		return
+	}
+	resp := LogMessagesResponse{Messages: messages}
+	if len(messages) == q.Limit {
+		resp.NextOffset = q.Offset + q.Limit
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *IoTEdge) ListDevices(c *gin.Context) {
+	logFields := log.Fields{"fnct": "ListDevices"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	devices, err := s.DeviceDB.GetDevices()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getting devices failed: %v", err)})
+		return
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, devices)
+}
+
+func (s *IoTEdge) GetDevice(c *gin.Context) {
+	logFields := log.Fields{"fnct": "GetDevice"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	dev, ok := s.deviceFromPath(c)
+	if !ok {
+		return
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, dev)
+}
+
+func (s *IoTEdge) UpdateDevice(c *gin.Context) {
+	logFields := log.Fields{"fnct": "UpdateDevice"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	var p UpdateDeviceReq
+	if err := c.BindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	dev, ok := s.deviceFromPath(c)
+	if !ok {
+		return
+	}
+	if p.Description != nil {
+		dev.Description = *p.Description
+	}
+	if p.Interval != nil {
+		dev.Interval = *p.Interval
+	}
+	if p.Buffer != nil {
+		dev.Buffer = *p.Buffer
+	}
+	if err := s.DeviceDB.Configure(dev); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("configuring device failed: %v", err)})
+		return
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, dev)
+}
+
+func (s *IoTEdge) DeleteDevice(c *gin.Context) {
+	logFields := log.Fields{"fnct": "DeleteDevice"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	dev, ok := s.deviceFromPath(c)
+	if !ok {
+		return
+	}
+	if err := s.DeviceDB.DeleteDevice(dev); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleting device failed: %v", err)})
+		return
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, dev)
+}
+
+func (s *IoTEdge) ListSensors(c *gin.Context) {
+	logFields := log.Fields{"fnct": "ListSensors"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	dev, ok := s.deviceFromPath(c)
+	if !ok {
+		return
+	}
+	sensors, err := s.DeviceDB.GetSensors(dev.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getting sensors failed: %v", err)})
+		return
+	}
+	if sensors == nil {
+		sensors = []Sensor{}
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, sensors)
+}
+
+func (s *IoTEdge) UpdateSensor(c *gin.Context) {
+	logFields := log.Fields{"fnct": "UpdateSensor"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	var p UpdateSensorReq
+	if err := c.BindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	sensor, ok := s.sensorFromPath(c)
+	if !ok {
+		return
+	}
+	if p.SensorOffset != nil {
+		sensor.SensorOffset = *p.SensorOffset
+	}
+	if err := s.DeviceDB.ConfigureSensor(sensor); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("configuring sensor failed: %v", err)})
+		return
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, sensor)
+}
+
+func (s *IoTEdge) DeleteSensor(c *gin.Context) {
+	logFields := log.Fields{"fnct": "DeleteSensor"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	sensor, ok := s.sensorFromPath(c)
+	if !ok {
+		return
+	}
+	if err := s.DeviceDB.DeleteSensor(sensor); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("deleting sensor failed: %v", err)})
+		return
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, sensor)
+}
+
+// deviceFromPath looks up the device named in the URL and writes the error
+// response if that fails.
+func (s *IoTEdge) deviceFromPath(c *gin.Context) (Device, bool) {
+	return s.findDevice(c, c.Param("name"))
+}
+
+// findDevice answers 404 for unknown devices.
+func (s *IoTEdge) findDevice(c *gin.Context, name string) (Device, bool) {
+	dev, err := s.DeviceDB.GetDevice(name)
+	if errors.Is(err, ErrDeviceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("device '%s' not found", name)})
+		return dev, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getting device failed: %v", err)})
+		return dev, false
+	}
+	return dev, true
+}
+
+func (s *IoTEdge) sensorFromPath(c *gin.Context) (Sensor, bool) {
+	dev, ok := s.deviceFromPath(c)
+	if !ok {
+		return Sensor{}, false
+	}
+	sensor, err := s.DeviceDB.GetSensor(dev.ID, c.Param("sensor"))
+	if errors.Is(err, ErrSensorNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("sensor '%s' not found", c.Param("sensor"))})
+		return sensor, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getting sensor failed: %v", err)})
+		return sensor, false
+	}
+	return sensor, true
+}
+
+func (s *IoTEdge) DeviceStatus(c *gin.Context) {
+	logFields := log.Fields{"fnct": "DeviceStatus"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	status, err := s.DeviceDB.GetDeviceStatus()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getting device status failed: %v", err)})
+		return
+	}
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *IoTEdge) QueryTimeseries(c *gin.Context) {
+	logFields := log.Fields{"fnct": "QueryTimeseries"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	q, err := parseTimeseriesQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+
+	rows, err := s.DeviceDB.QueryTimeseries(s.IoTConfig.TimeseriesTable, q)
+	if err != nil {
+		log.WithFields(logFields).Errorf("Failed to query timeseries: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to query timeseries: %v", err)})
+		return
+	}
+
+	SetGinHeaders(c)
+	c.JSON(http.StatusOK, rows)
+}
+
+// Export streams the raw rows of the tags in the requested format, see
+// ExportTimeseries.
+func (s *IoTEdge) Export(c *gin.Context) {
+	logFields := log.Fields{"fnct": "Export"}
+	log.WithFields(logFields).Infof("Got request: %v", c.Request.URL)
+
+	q, err := parseTimeseriesQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	format := c.DefaultQuery("format", ExportCSV)
+	if _, err := newTimeseriesExporter(nil, format); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+
+	c.Header("Content-Type", ExportContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`,
+		s.IoTConfig.TimeseriesTable, ExportFileExtension(format)))
+	if _, err := s.DeviceDB.ExportTimeseries(c.Writer, s.IoTConfig.TimeseriesTable, q, format); err != nil {
+		log.WithFields(logFields).Errorf("Failed to export timeseries: %v", err)
+		if c.Writer.Written() {
+			// the status is sent already, the client sees the truncated output
+			return
+		}
+		c.Writer.Header().Del("Content-Type")
+		c.Writer.Header().Del("Content-Disposition")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to export timeseries: %v", err)})
+	}
+}
+
+// parseTimeseriesQuery reads tag (repeatable or comma separated), start, end,
+// bucket and aggregate. The range defaults to the last 24 hours.
+func parseTimeseriesQuery(c *gin.Context) (TimeseriesQuery, error) {
+	q := TimeseriesQuery{
+		End:       time.Now().UTC(),
+		Aggregate: c.DefaultQuery("aggregate", AggregateAvg),
+	}
+	for _, tag := range c.QueryArray("tag") {
+		for _, t := range strings.Split(tag, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				q.Tags = append(q.Tags, t)
+			}
+		}
+	}
+	if len(q.Tags) == 0 {
+		return q, fmt.Errorf("at least one tag is required")
+	}
+	if end := c.Query("end"); end != "" {
+		t, err := ParseTimestamp(end)
+		if err != nil {
+			return q, err
+		}
+		q.End = t
+	}
+	q.Start = q.End.Add(-24 * time.Hour)
+	if start := c.Query("start"); start != "" {
+		t, err := ParseTimestamp(start)
+		if err != nil {
+			return q, err
+		}
+		q.Start = t
+	}
+	if !q.Start.Before(q.End) {
+		return q, fmt.Errorf("start must be before end")
+	}
+	if bucket := c.Query("bucket"); bucket != "" {
+		d, err := time.ParseDuration(bucket)
+		if err != nil {
+			return q, fmt.Errorf("invalid bucket: %v", err)
+		}
+		q.Bucket = d
+	}
+	return q, nil
+}
+
+func parseLogQuery(c *gin.Context) (LogQuery, error) {
+	q := LogQuery{
+		Device: c.Query("device"),
+		Text:   c.Query("q"),
+		Limit:  defaultLogLimit,
+	}
+	if level := c.Query("level"); level != "" {
+		l, err := ParseLoglevel(level)
+		if err != nil {
+			return q, err
+		}
+		q.MinLevel = l
+	}
+	for param, dest := range map[string]*time.Time{"start": &q.Start, "end": &q.End} {
+		if value := c.Query(param); value != "" {
+			t, err := ParseTimestamp(value)
+			if err != nil {
+				return q, err
+			}
+			*dest = t
+		}
+	}
+	for param, dest := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if value := c.Query(param); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("invalid %s '%s'", param, value)
+			}
+			*dest = n
+		}
+	}
+	if q.Limit == 0 || q.Limit > maxLogLimit {
+		return q, fmt.Errorf("limit must be between 1 and %d", maxLogLimit)
+	}
+	switch c.DefaultQuery("order", "desc") {
+	case "asc":
+		q.Ascending = true
+	case "desc":
+	default:
+		return q, fmt.Errorf("order must be asc or desc")
+	}
+	return q, nil
+}
+
 // Helper function for CORS headers
 func SetGinHeaders(c *gin.Context) {
 	origin := c.GetHeader("Origin")
@@ -233,6 +682,6 @@ func SetGinHeaders(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", origin)
 	c.Header("Access-Control-Allow-Credentials", "true")
 	c.Header("Access-Control-Allow-Methods", "PUT, POST, PATCH, OPTIONS, GET, DELETE")
-	c.Header("Access-Control-Allow-Headers", "content-type")
+	c.Header("Access-Control-Allow-Headers", "content-type, authorization")
 	c.Header("Access-Control-Max-Age", "240")
 }
@@ -0,0 +1,294 @@
+package iotedge
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultLineProtocolTag names the tags like the devices do, e.g. the line
+// "Basel3 Temperature=21.5" is stored as Basel3Temperature.
+const defaultLineProtocolTag = "{measurement}{field}"
+
+const (
+	// maxLineProtocolLine limits the length of a single line.
+	maxLineProtocolLine = 1024 * 1024
+	// maxLineProtocolBody limits the request and, if compressed, the
+	// decompressed body.
+	maxLineProtocolBody = 32 * 1024 * 1024
+)
+
+var lineProtocolPrecisions = map[string]time.Duration{
+	"ns": time.Nanosecond, "n": time.Nanosecond,
+	"us": time.Microsecond, "u": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+type lineField struct {
+	key   string
+	value float64
+}
+
+// linePoint is a parsed line. String fields are left out, booleans are
+// stored as 1 and 0.
+type linePoint struct {
+	measurement string
+	tags        map[string]string
+	fields      []lineField
+	time        time.Time
+}
+
+// parseLine parses a line of the InfluxDB line protocol:
+// measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseLine(line string, precision time.Duration, now time.Time) (linePoint, error) {
+	p := linePoint{tags: map[string]string{}, time: now}
+	var i int
+	p.measurement, i = readLineToken(line, 0, ", ", ", ")
+	if p.measurement == "" {
+		return p, fmt.Errorf("missing measurement")
+	}
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = readLineToken(line, i+1, "=", ",= ")
+		if i >= len(line) || line[i] != '=' || key == "" {
+			return p, fmt.Errorf("invalid tag '%s'", key)
+		}
+		value, i = readLineToken(line, i+1, ", ", ",= ")
+		if value == "" {
+			return p, fmt.Errorf("tag '%s' has no value", key)
+		}
+		p.tags[key] = value
+	}
+	if i >= len(line) || line[i] != ' ' {
+		return p, fmt.Errorf("missing fields")
+	}
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	for {
+		var key string
+		key, i = readLineToken(line, i, "=", ",= ")
+		if i >= len(line) || line[i] != '=' || key == "" {
+			return p, fmt.Errorf("invalid field '%s'", key)
+		}
+		i++
+		if i < len(line) && line[i] == '"' {
+			end, err := skipQuoted(line, i)
+			if err != nil {
+				return p, fmt.Errorf("field '%s': %w", key, err)
+			}
+			i = end
+		} else {
+			var raw string
+			raw, i = readLineToken(line, i, ", ", "")
+			value, err := parseFieldValue(raw)
+			if err != nil {
+				return p, fmt.Errorf("field '%s': %w", key, err)
+			}
+			p.fields = append(p.fields, lineField{key: key, value: value})
+		}
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+		i++
+	}
+	if timestamp := strings.TrimSpace(line[i:]); timestamp != "" {
+		n, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid timestamp '%s'", timestamp)
+		}
+		if n > math.MaxInt64/int64(precision) || n < math.MinInt64/int64(precision) {
+			return p, fmt.Errorf("timestamp '%s' out of range", timestamp)
+		}
+		p.time = time.Unix(0, n*int64(precision))
+	}
+	return p, nil
+}
+
+// readLineToken reads from i until one of the stop characters. A backslash
+// escapes the characters in escapable.
+func readLineToken(line string, i int, stops string, escapable string) (string, int) {
+	var token strings.Builder
+	for i < len(line) {
+		ch := line[i]
+		if ch == '\\' && i+1 < len(line) && (strings.IndexByte(escapable, line[i+1]) >= 0 || line[i+1] == '\\') {
+			token.WriteByte(line[i+1])
+			i += 2
+			continue
+		}
+		if strings.IndexByte(stops, ch) >= 0 {
+			break
+		}
+		token.WriteByte(ch)
+		i++
+	}
+	return token.String(), i
+}
+
+// skipQuoted returns the position after the string field starting at i.
+func skipQuoted(line string, i int) (int, error) {
+	for i++; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return i, fmt.Errorf("unterminated string")
+}
+
+func parseFieldValue(raw string) (float64, error) {
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	if n, ok := strings.CutSuffix(raw, "i"); ok {
+		v, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid integer '%s'", raw)
+		}
+		return float64(v), nil
+	}
+	if n, ok := strings.CutSuffix(raw, "u"); ok {
+		v, err := strconv.ParseUint(n, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid unsigned integer '%s'", raw)
+		}
+		return float64(v), nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid value '%s'", raw)
+	}
+	return v, nil
+}
+
+// lineProtocolTag expands {measurement}, {field} and the tag keys of the
+// line in template. Missing tag keys are left empty.
+func lineProtocolTag(template string, p linePoint, field string) string {
+	return expandTagTemplate(template, func(name string) string {
+		switch name {
+		case "measurement":
+			return p.measurement
+		case "field":
+			return field
+		}
+		return p.tags[name]
+	})
+}
+
+// expandTagTemplate replaces the {name} placeholders of template with
+// value(name).
+func expandTagTemplate(template string, value func(string) string) string {
+	return templatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return value(placeholder[1 : len(placeholder)-1])
+	})
+}
+
+// parseLineProtocol reads all lines of body and groups the values by tag.
+func parseLineProtocol(body io.Reader, template string, precision time.Duration, now time.Time) ([]timeseries.TimeseriesImportStruct, error) {
+	var data []timeseries.TimeseriesImportStruct
+	index := map[string]int{}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineProtocolLine)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parseLine(line, precision, now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		timestamp := p.time.UTC().Format(TimestampFormat)
+		for _, field := range p.fields {
+			tag := lineProtocolTag(template, p, field.key)
+			i, ok := index[tag]
+			if !ok {
+				i = len(data)
+				index[tag] = i
+				data = append(data, timeseries.TimeseriesImportStruct{Tag: tag})
+			}
+			data[i].Timestamps = append(data[i].Timestamps, timestamp)
+			data[i].Values = append(data[i].Values, strconv.FormatFloat(field.value, 'f', -1, 64))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+	}
+	return data, nil
+}
+
+// WriteLineProtocol stores data sent in the InfluxDB line protocol, e.g. by
+// Telegraf. The tags are named with LineProtocolTag of the config. Nothing
+// is stored if a line is invalid.
+func (s *IoTEdge) WriteLineProtocol(c *gin.Context) {
+	logFields := log.Fields{"fnct": "WriteLineProtocol"}
+	precision, ok := lineProtocolPrecisions[c.DefaultQuery("precision", "ns")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: invalid precision '%s'", c.Query("precision"))})
+		return
+	}
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxLineProtocolBody)
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+			return
+		}
+		defer gz.Close()
+		body = http.MaxBytesReader(c.Writer, gz, maxLineProtocolBody)
+	}
+	template := s.IoTConfig.LineProtocolTag
+	if template == "" {
+		template = defaultLineProtocolTag
+	}
+
+	data, err := parseLineProtocol(body, template, precision, time.Now())
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	if err != nil {
+		log.WithFields(logFields).Warnf("Invalid line protocol: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	if !s.mayWriteTags(c, importTags(data)) {
+		return
+	}
+	for i, ts := range data {
+		data[i] = s.prepareTimeseries(ts, true)
+	}
+	if err := s.DeviceDB.InsertTimeseriesBatch(data, s.IoTConfig.TimeseriesTable); err != nil {
+		log.WithFields(logFields).Errorf("Failed to save timeseries: %v", err)
+		c.JSON(insertErrorStatus(err), gin.H{"error": fmt.Sprintf("Failed to save timeseries: %v", err)})
+		return
+	}
+	s.evaluateAlerts(data)
+	log.WithFields(logFields).Infof("Stored %d tags", len(data))
+	c.Status(http.StatusNoContent)
+}
@@ -1,7 +1,11 @@
 package iotedge
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pat-rohn/timeseries"
 	log "github.com/sirupsen/logrus"
@@ -16,15 +20,99 @@ const (
 	Error
 )
 
+var loglevelNames = []string{"debug", "info", "warning", "error"}
+
+func (l Loglevel) String() string {
+	if l >= 0 && int(l) < len(loglevelNames) {
+		return loglevelNames[l]
+	}
+	return strconv.Itoa(int(l))
+}
+
+// ParseLoglevel accepts the name or the number of a level.
+func ParseLoglevel(s string) (Loglevel, error) {
+	for i, name := range loglevelNames {
+		if strings.EqualFold(s, name) {
+			return Loglevel(i), nil
+		}
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil {
+		return Debug, fmt.Errorf("invalid log level '%s'", s)
+	}
+	return Loglevel(level), nil
+}
+
+// LogMessage is a log line of a device. Devices may send the Timestamp of
+// the message, otherwise the receive time is stored. ID is set on messages
+// read from the DB.
 type LogMessage struct {
-	Device string
-	Text   string
-	Level  Loglevel
+	ID        int64     `json:",omitzero"`
+	Timestamp time.Time `json:",omitzero"`
+	Device    string
+	Text      string
+	Level     Loglevel
 }
 
+// LogQuery filters the stored log messages. Zero values don't filter,
+// Limit defaults to defaultLogLimit.
+type LogQuery struct {
+	Device    string
+	MinLevel  Loglevel
+	Start     time.Time
+	End       time.Time
+	Text      string
+	Limit     int
+	Offset    int
+	Ascending bool
+	// AfterID only returns messages stored after the one with this ID.
+	AfterID int64
+}
+
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 1000
+)
+
+// maxLogClockSkew is how far a device's Timestamp may be ahead of the
+// server's clock.
+const maxLogClockSkew = time.Hour
+
+// ValidateLogMessage refuses messages of devices whose clock is wrong, e.g.
+// not yet synchronized.
+func ValidateLogMessage(msg LogMessage, now time.Time) error {
+	if msg.Timestamp.IsZero() {
+		return nil
+	}
+	if msg.Timestamp.After(now.Add(maxLogClockSkew)) {
+		return fmt.Errorf("timestamp %v of %s is in the future", msg.Timestamp, msg.Device)
+	}
+	if msg.Timestamp.Year() < 2000 {
+		return fmt.Errorf("timestamp %v of %s is before 2000", msg.Timestamp, msg.Device)
+	}
+	return nil
+}
+
+// logBatchRows limits the rows per INSERT statement.
+const logBatchRows = 200
+
 type LoggingDB struct {
 	*timeseries.DbHandler
-	conf timeseries.DBConfig
+	conf  timeseries.DBConfig
+	batch *logBatch
+}
+
+// logBatch coalesces concurrent inserts: while one caller writes, the
+// messages of the others are collected and written together afterwards.
+type logBatch struct {
+	mutex   sync.Mutex
+	pending []*logRequest
+	writing bool
+}
+
+type logRequest struct {
+	msgs []LogMessage
+	done chan error
 }
 
 var onceLoggingDB sync.Once
@@ -40,25 +128,14 @@ func GetLoggingDB(config timeseries.DBConfig) *LoggingDB {
 		if dbhandler == nil {
 			dbhandler = timeseries.DBHandler(config)
 		}
-		loggingDB = &LoggingDB{conf: config}
+		loggingDB = &LoggingDB{conf: config, batch: &logBatch{}}
 		loggingDB.DbHandler = dbhandler
-		timeStampStr := "DATETIME"
-
-		if config.UsePostgres {
-			timeStampStr = "TIMESTAMP"
+		if err := loggingDB.migrateLogsTable(); err != nil {
+			logger.Fatalf("failed to migrate logging table:%v", err)
 		}
-
-		sqlStr := `CREATE TABLE IF NOT EXISTS logs (
-			timestamp ` + timeStampStr + ` DEFAULT CURRENT_TIMESTAMP,
-			device TEXT NOT NULL,
-			text TEXT DEFAULT '',
-			level INTEGER DEFAULT 2,
-			PRIMARY KEY (timestamp, device)
-);`
-		if _, err := loggingDB.ExecuteQuery(sqlStr); err != nil {
+		if err := loggingDB.createLogsTable(); err != nil {
 			logger.Fatalf("failed to create logging table:%v", err)
 		}
-
 	})
 	if !compareConfigs(deviceDB.conf, config) {
 		logger.Fatalf("Config must not change %+v to %+v", deviceDB.conf, config)
@@ -68,10 +145,86 @@ func GetLoggingDB(config timeseries.DBConfig) *LoggingDB {
 	return loggingDB
 }
 
-func (s *IoTEdge) LogMessage(msg LogMessage) error {
+func (l *LoggingDB) createLogsTable() error {
+	return l.execAll(l.logsTableStatements())
+}
+
+func (l *LoggingDB) logsTableStatements() []string {
+	idStr := "id INTEGER PRIMARY KEY AUTOINCREMENT"
+	timeStampStr := "DATETIME"
+	if l.conf.UsePostgres {
+		idStr = "id BIGSERIAL PRIMARY KEY"
+		timeStampStr = "TIMESTAMP"
+	}
+	return []string{
+		`CREATE TABLE IF NOT EXISTS logs (
+			` + idStr + `,
+			timestamp ` + timeStampStr + ` NOT NULL,
+			device TEXT NOT NULL,
+			text TEXT DEFAULT '',
+			level INTEGER DEFAULT 2
+);`,
+		"CREATE INDEX IF NOT EXISTS logs_timestamp_idx ON logs (timestamp)",
+		"CREATE INDEX IF NOT EXISTS logs_device_timestamp_idx ON logs (device, timestamp)",
+	}
+}
+
+// migrateLogsTable converts the logs table of older versions. Its primary
+// key (timestamp, device) with second resolution rejected several messages
+// of a device within the same second. The conversion runs in a transaction,
+// an interrupted migration leaves the old table as it was.
+func (l *LoggingDB) migrateLogsTable() error {
+	logger := log.WithFields(log.Fields{"fnct": "migrateLogsTable"})
+	hasDevice, err := hasColumn(l.DbHandler, l.conf.UsePostgres, "logs", "device")
+	if err != nil || !hasDevice {
+		return err
+	}
+	hasID, err := hasColumn(l.DbHandler, l.conf.UsePostgres, "logs", "id")
+	if err != nil || hasID {
+		return err
+	}
+	logger.Infoln("Add surrogate key to logs table")
+	var statements []string
+	if l.conf.UsePostgres {
+		statements = []string{
+			"ALTER TABLE logs DROP CONSTRAINT IF EXISTS logs_pkey",
+			"ALTER TABLE logs ALTER COLUMN timestamp DROP DEFAULT",
+			"ALTER TABLE logs ADD COLUMN id BIGSERIAL PRIMARY KEY",
+		}
+	} else {
+		// sqlite can't change the primary key, the rows are copied instead
+		statements = append([]string{"ALTER TABLE logs RENAME TO logs_old"}, l.logsTableStatements()...)
+		statements = append(statements,
+			`INSERT INTO logs (timestamp, device, text, level)
+				SELECT strftime('%Y-%m-%d %H:%M:%f', timestamp), device, text, level FROM logs_old ORDER BY timestamp`,
+			"DROP TABLE logs_old",
+		)
+	}
+	tx, err := beginTx(l.conf)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.execAll(statements); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (l *LoggingDB) execAll(statements []string) error {
+	for _, sqlStr := range statements {
+		rows, err := l.ExecuteQuery(sqlStr)
+		if err != nil {
+			return fmt.Errorf("'%s' failed: %v", sqlStr, err)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+func logToConsole(msg LogMessage) {
 	logger := log.WithFields(log.Fields{"fnct": "LogMessage",
 		"device": msg.Device, "level": msg.Level})
-	logger.Infof("Log message")
 	switch msg.Level {
 	case Debug:
 		logger.Debug(msg.Text)
@@ -84,44 +237,193 @@ func (s *IoTEdge) LogMessage(msg LogMessage) error {
 	default:
 		logger.Info(msg.Text)
 	}
-	if err := GetLoggingDB(s.IoTConfig.DbConfig).InsertLogMessage(msg); err != nil {
-		logger.Errorf("failed to log message to DB:%v", err)
+}
+
+func (s *IoTEdge) LogMessage(msg LogMessage) error {
+	return s.LogMessages([]LogMessage{msg})
+}
+
+func (s *IoTEdge) LogMessages(msgs []LogMessage) error {
+	logger := log.WithFields(log.Fields{"fnct": "LogMessages"})
+	logger.Infof("Log %d messages", len(msgs))
+	for _, msg := range msgs {
+		logToConsole(msg)
+	}
+	if err := GetLoggingDB(s.IoTConfig.DbConfig).InsertLogMessages(msgs); err != nil {
+		logger.Errorf("failed to log messages to DB:%v", err)
 		return err
 	}
 	return nil
 }
+
 func (l *LoggingDB) InsertLogMessage(msg LogMessage) error {
-	logger := log.WithFields(log.Fields{"fnct": "InsertLogMessage",
-		"device": msg.Device, "level": msg.Level})
-	logger.Infof("Insert log message into DB")
-	sqlStr := `INSERT INTO logs (device, text, level) 
-               VALUES (?, ?, ?)`
-	if _, err := l.ExecuteQuery(sqlStr, msg.Device, msg.Text, int(msg.Level)); err != nil {
-		logger.Errorf("failed to insert log message:%v", err)
-		return err
+	return l.InsertLogMessages([]LogMessage{msg})
+}
+
+// InsertLogMessages stores the messages and returns once they are written.
+// Messages without timestamp get the current time.
+func (l *LoggingDB) InsertLogMessages(msgs []LogMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	req := &logRequest{msgs: make([]LogMessage, len(msgs)), done: make(chan error, 1)}
+	for i, msg := range msgs {
+		if msg.Timestamp.IsZero() {
+			msg.Timestamp = now
+		}
+		req.msgs[i] = msg
+	}
+
+	b := l.batch
+	b.mutex.Lock()
+	b.pending = append(b.pending, req)
+	if b.writing {
+		b.mutex.Unlock()
+		return <-req.done
+	}
+	b.writing = true
+	for len(b.pending) > 0 {
+		reqs := b.pending
+		b.pending = nil
+		b.mutex.Unlock()
+		l.writeLogRequests(reqs)
+		b.mutex.Lock()
+	}
+	b.writing = false
+	b.mutex.Unlock()
+	return <-req.done
+}
+
+// writeLogRequests writes the requests in as few statements as possible.
+// Each request gets the error of the statement its messages were part of.
+func (l *LoggingDB) writeLogRequests(reqs []*logRequest) {
+	var chunk []*logRequest
+	rows := 0
+	flush := func() {
+		var msgs []LogMessage
+		for _, req := range chunk {
+			msgs = append(msgs, req.msgs...)
+		}
+		err := l.insertLogRows(msgs)
+		for _, req := range chunk {
+			req.done <- err
+		}
+		chunk = nil
+		rows = 0
+	}
+	for _, req := range reqs {
+		if rows > 0 && rows+len(req.msgs) > logBatchRows {
+			flush()
+		}
+		chunk = append(chunk, req)
+		rows += len(req.msgs)
+	}
+	flush()
+}
+
+func (l *LoggingDB) insertLogRows(msgs []LogMessage) error {
+	logger := log.WithFields(log.Fields{"fnct": "insertLogRows"})
+	logger.Infof("Insert %d log messages into DB", len(msgs))
+	for start := 0; start < len(msgs); start += logBatchRows {
+		chunk := msgs[start:min(start+logBatchRows, len(msgs))]
+		args := make([]interface{}, 0, len(chunk)*4)
+		for _, msg := range chunk {
+			args = append(args, msg.Timestamp.UTC().Format(TimestampFormat), msg.Device, msg.Text, int(msg.Level))
+		}
+		sqlStr := "INSERT INTO logs (timestamp, device, text, level) VALUES " +
+			strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?),", len(chunk)), ",")
+		if _, err := l.ExecuteQuery(sqlStr, args...); err != nil {
+			logger.Errorf("failed to insert log messages:%v", err)
+			serverMetrics.dbError("log")
+			return err
+		}
 	}
 	return nil
 }
+
+// LatestLogID returns the ID of the last stored message, 0 if there is none.
+func (l *LoggingDB) LatestLogID() (int64, error) {
+	rows, err := l.ExecuteQuery("SELECT COALESCE(MAX(id), 0) FROM logs")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var id int64
+	if rows.Next() {
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+	}
+	return id, rows.Err()
+}
+
+// GetLogMessages returns the latest messages of all devices.
 func (l *LoggingDB) GetLogMessages(limit int) ([]LogMessage, error) {
-	logger := log.WithFields(log.Fields{"fnct": "GetLogMessages", "limit": limit})
-	logger.Infof("Get log messages from DB")
-	sqlStr := `SELECT timestamp, device, text, level FROM logs ORDER BY timestamp DESC LIMIT ?;`
-	rows, err := l.ExecuteQuery(sqlStr, limit)
+	return l.QueryLogMessages(LogQuery{Limit: limit})
+}
+
+// QueryLogMessages returns the messages matching q, newest first unless
+// Ascending is set.
+func (l *LoggingDB) QueryLogMessages(q LogQuery) ([]LogMessage, error) {
+	logger := log.WithFields(log.Fields{"fnct": "QueryLogMessages"})
+	logger.Infof("Get log messages from DB: %+v", q)
+	if q.Limit <= 0 {
+		q.Limit = defaultLogLimit
+	}
+	q.Limit = min(q.Limit, maxLogLimit)
+	conds := []string{"level >= ?"}
+	args := []interface{}{int(q.MinLevel)}
+	if q.Device != "" {
+		conds = append(conds, "device = ?")
+		args = append(args, q.Device)
+	}
+	if !q.Start.IsZero() {
+		conds = append(conds, "timestamp >= ?")
+		args = append(args, q.Start.UTC().Format(TimestampFormat))
+	}
+	if !q.End.IsZero() {
+		conds = append(conds, "timestamp < ?")
+		args = append(args, q.End.UTC().Format(TimestampFormat))
+	}
+	if q.AfterID > 0 {
+		conds = append(conds, "id > ?")
+		args = append(args, q.AfterID)
+	}
+	if q.Text != "" {
+		conds = append(conds, "LOWER(text) LIKE ?")
+		args = append(args, "%"+strings.ToLower(q.Text)+"%")
+	}
+	order := "DESC"
+	if q.Ascending {
+		order = "ASC"
+	}
+	orderBy := "timestamp " + order + ", id " + order
+	if q.AfterID > 0 {
+		// new messages are followed in the order they were stored
+		orderBy = "id " + order
+	}
+	sqlStr := `SELECT id, timestamp, device, text, level FROM logs WHERE ` + strings.Join(conds, " AND ") +
+		` ORDER BY ` + orderBy + ` LIMIT ? OFFSET ?`
+	args = append(args, q.Limit, q.Offset)
+	rows, err := l.ExecuteQuery(sqlStr, args...)
 	if err != nil {
 		logger.Errorf("failed to get log messages:%v", err)
+		serverMetrics.dbError("query")
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []LogMessage
+	messages := []LogMessage{}
 	for rows.Next() {
 		var msg LogMessage
-		var timestamp string // Not used currently
+		var timestamp dbTime
 		var level int
-		if err := rows.Scan(&timestamp, &msg.Device, &msg.Text, &level); err != nil {
+		if err := rows.Scan(&msg.ID, &timestamp, &msg.Device, &msg.Text, &level); err != nil {
 			logger.Errorf("failed to scan log message:%v", err)
 			return nil, err
 		}
+		msg.Timestamp = timestamp.Time
 		msg.Level = Loglevel(level)
 		messages = append(messages, msg)
 	}
@@ -0,0 +1,233 @@
+package iotedge
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ingestSourceHTTP = "http"
+	ingestSourceMQTT = "mqtt"
+)
+
+// flushBuckets are the upper bounds in seconds of the flush duration
+// histogram.
+var flushBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+// metricsRegistry collects the counters of the server. Gauges of the broker
+// are read when /metrics is scraped.
+type metricsRegistry struct {
+	mutex       sync.Mutex
+	requests    map[requestKey]uint64
+	ingested    map[string]uint64
+	dbErrors    map[string]uint64
+	flushCounts []uint64
+	flushSum    float64
+	flushCount  uint64
+}
+
+var serverMetrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requests:    make(map[requestKey]uint64),
+		ingested:    make(map[string]uint64),
+		dbErrors:    make(map[string]uint64),
+		flushCounts: make([]uint64, len(flushBuckets)),
+	}
+}
+
+func (m *metricsRegistry) request(route string, method string, status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.requests[requestKey{route: route, method: method, status: status}]++
+}
+
+func (m *metricsRegistry) ingest(source string, points int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ingested[source] += uint64(points)
+}
+
+func (m *metricsRegistry) dbError(operation string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dbErrors[operation]++
+}
+
+func (m *metricsRegistry) observeFlush(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seconds := d.Seconds()
+	for i, bound := range flushBuckets {
+		if seconds <= bound {
+			m.flushCounts[i]++
+		}
+	}
+	m.flushSum += seconds
+	m.flushCount++
+}
+
+// metricsMiddleware counts the requests per route, method and status.
+func metricsMiddleware(c *gin.Context) {
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	serverMetrics.request(route, c.Request.Method, c.Writer.Status())
+}
+
+// Metrics serves the metrics in the Prometheus text exposition format.
+func (s *IoTEdge) Metrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := serverMetrics.write(c.Writer); err != nil {
+		log.WithFields(log.Fields{"fnct": "Metrics"}).Errorf("Failed to write metrics: %v", err)
+	}
+}
+
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricsWriter) header(name string, kind string, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw *metricsWriter) sample(name string, labels []string, value float64) {
+	mw.printf("%s%s %s\n", name, formatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
+
+// formatLabels expects name/value pairs.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], escaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *metricsRegistry) write(w io.Writer) error {
+	mw := &metricsWriter{w: w}
+	m.mutex.Lock()
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	mw.header("iotedge_http_requests_total", "counter", "HTTP requests by route, method and status.")
+	for _, key := range requests {
+		mw.sample("iotedge_http_requests_total",
+			[]string{"route", key.route, "method", key.method, "status", strconv.Itoa(key.status)},
+			float64(m.requests[key]))
+	}
+	mw.header("iotedge_ingested_points_total", "counter", "Received timeseries values by source.")
+	for _, source := range sortedKeys(m.ingested) {
+		mw.sample("iotedge_ingested_points_total", []string{"source", source}, float64(m.ingested[source]))
+	}
+	mw.header("iotedge_db_errors_total", "counter", "Failed database operations.")
+	for _, operation := range sortedKeys(m.dbErrors) {
+		mw.sample("iotedge_db_errors_total", []string{"operation", operation}, float64(m.dbErrors[operation]))
+	}
+	mw.header("iotedge_flush_duration_seconds", "histogram", "Duration of writing buffered MQTT data to the database.")
+	for i, bound := range flushBuckets {
+		mw.sample("iotedge_flush_duration_seconds_bucket",
+			[]string{"le", strconv.FormatFloat(bound, 'g', -1, 64)}, float64(m.flushCounts[i]))
+	}
+	mw.sample("iotedge_flush_duration_seconds_bucket", []string{"le", "+Inf"}, float64(m.flushCount))
+	mw.sample("iotedge_flush_duration_seconds_sum", nil, m.flushSum)
+	mw.sample("iotedge_flush_duration_seconds_count", nil, float64(m.flushCount))
+	m.mutex.Unlock()
+
+	if broker := activeBroker.Load(); broker != nil {
+		broker.writeMetrics(mw)
+	}
+	return mw.err
+}
+
+// writeMetrics adds the gauges of a running broker.
+func (m *MQTTEdge) writeMetrics(mw *metricsWriter) {
+	mw.header("iotedge_mqtt_clients_connected", "gauge", "Clients connected to the MQTT broker.")
+	mw.sample("iotedge_mqtt_clients_connected", nil, float64(atomic.LoadInt64(&m.MQTTserver.System.ClientsConnected)))
+	mw.header("iotedge_mqtt_buffered_points", "gauge", "Values received via MQTT waiting for the next flush.")
+	mw.sample("iotedge_mqtt_buffered_points", nil, float64(m.timeseriesHandler.bufferedPoints()))
+	if m.writer != nil {
+		stats := m.writer.Stats()
+		mw.header("iotedge_writer_pending_points", "gauge", "Flushed values not yet written to the database.")
+		mw.sample("iotedge_writer_pending_points", nil, float64(stats.Pending))
+		mw.header("iotedge_writer_written_points_total", "counter", "Values written to the database.")
+		mw.sample("iotedge_writer_written_points_total", nil, float64(stats.Written))
+		mw.header("iotedge_writer_retried_points_total", "counter", "Values whose write had to be retried.")
+		mw.sample("iotedge_writer_retried_points_total", nil, float64(stats.Retried))
+		mw.header("iotedge_writer_dead_letter_points_total", "counter", "Invalid values moved to the dead_letters table.")
+		mw.sample("iotedge_writer_dead_letter_points_total", nil, float64(stats.DeadLettered))
+		mw.header("iotedge_writer_dropped_points_total", "counter", "Values dropped because too many were pending.")
+		mw.sample("iotedge_writer_dropped_points_total", nil, float64(stats.Dropped))
+	}
+	if m.queue != nil {
+		stats, err := m.queue.Stats()
+		if err != nil {
+			serverMetrics.dbError("redirect_queue")
+			return
+		}
+		mw.header("iotedge_redirect_queue_batches", "gauge", "Batches waiting to be redirected.")
+		mw.sample("iotedge_redirect_queue_batches", nil, float64(stats.Depth))
+		mw.header("iotedge_redirect_queue_bytes", "gauge", "Size of the batches waiting to be redirected.")
+		mw.sample("iotedge_redirect_queue_bytes", nil, float64(stats.Bytes))
+		mw.header("iotedge_redirect_dead_batches", "gauge", "Batches the upstream refused as invalid.")
+		mw.sample("iotedge_redirect_dead_batches", nil, float64(stats.Dead))
+		mw.header("iotedge_redirect_sent_total", "counter", "Batches redirected successfully.")
+		mw.sample("iotedge_redirect_sent_total", nil, float64(stats.Sent))
+		mw.header("iotedge_redirect_failures_total", "counter", "Failed attempts to redirect a batch.")
+		mw.sample("iotedge_redirect_failures_total", nil, float64(stats.Failed))
+		mw.header("iotedge_redirect_dropped_total", "counter", "Batches dropped because the queue was full or they exceeded its size.")
+		mw.sample("iotedge_redirect_dropped_total", nil, float64(stats.Dropped))
+	}
+}
@@ -1,18 +1,16 @@
 package iotedge
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"fmt"
-	"io"
-	"net/http"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	mqttserver "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/events"
 	"github.com/mochi-co/mqtt/server/listeners"
 	"github.com/pat-rohn/timeseries"
 	log "github.com/sirupsen/logrus"
@@ -22,13 +20,40 @@ type TimeseriesHandler struct {
 	DataMessageHandler *mqtt.MessageHandler
 	data               []*timeseries.TimeseriesImportStruct
 	dataMutex          *sync.Mutex
+	deviceDB           *DeviceDB
+	topicMapper        *topicMapper
+	// processing tracks messages that are not yet in data
+	processing sync.WaitGroup
 }
 
+// MQTTEdge runs the embedded broker and stores what devices publish.
 type MQTTEdge struct {
 	MQTTserver        *mqttserver.Server
+	Port              int
+	config            IoTConfig
 	timeseriesHandler *TimeseriesHandler
+	writer            *timeseriesWriter
+	deviceDB          *DeviceDB
+	alerts            *AlertEngine
+	queue             *ForwardQueue
+
+	// lastFlush is the unix time in nanoseconds of the last successful
+	// write or of the last flush that found nothing left to write
+	lastFlush atomic.Int64
+
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
+// activeBroker is the broker running in this process, if any. Metrics and
+// readiness checks read its state.
+var activeBroker atomic.Pointer[MQTTEdge]
+
+// mqttFlushTimeout bounds how long a shutdown waits for the database to
+// take the buffered data.
+const mqttFlushTimeout = 30 * time.Second
+
 func (h *TimeseriesHandler) handleConnected(client mqtt.Client) {
 	fmt.Println("TimeseriesHandler Connected")
 	logFields := log.Fields{"Handler": "TimeseriesHandler", "fnct": "handleConnected"}
@@ -47,48 +72,94 @@ func (h *TimeseriesHandler) handleMessage(client mqtt.Client, msg mqtt.Message)
 	payload := msg.Payload()
 	logFields := log.Fields{"fnct": "handleMessage"}
 
-	go h.processData(msg.Topic(), string(payload))
+	if name, ack, ok := parseConfigTopic(msg.Topic()); ok {
+		if ack {
+			go h.processConfigAck(name, string(payload))
+		}
+		return
+	}
+	h.processing.Add(1)
+	go func() {
+		defer h.processing.Done()
+		h.processData(msg.Topic(), string(payload))
+	}()
 	log.WithFields(logFields).Tracef("Message received: %s", payload)
 	//fmt.Printf("TestHandler handleMessage %s", string(payload))
 
 }
 
 func (h *TimeseriesHandler) processData(topic string, payload string) {
-	splittedTopic := strings.Split(topic, "/")
-	if len(splittedTopic) <= 2 {
-		log.Errorf("No valid data to store into the dabase: %v", splittedTopic)
+	uniqueID, ok := h.topicMapper.Tag(topic)
+	if !ok {
+		log.Tracef("Ignore message on %s", topic)
 		return
 	}
-	uniqueID := splittedTopic[len(splittedTopic)-2]
-	log.Tracef("Received message: %s from topic: %s (%s)\n", string(payload), uniqueID, splittedTopic)
-	_, err := strconv.ParseFloat(string(payload), 32)
+	log.Tracef("Received message: %s from topic: %s (%s)\n", string(payload), uniqueID, topic)
+	measurements, err := parseMQTTPayload(uniqueID, payload, time.Now())
 	if err != nil {
-		log.Errorf("Not a valid number: %v", payload)
+		log.Errorf("Invalid payload on %s: %v", topic, err)
 		return
 	}
-	timestamp := time.Now().UTC().Format("2006-01-02 15:04:05.000")
+	serverMetrics.ingest(ingestSourceMQTT, len(measurements))
+	if h.deviceDB != nil {
+		for _, m := range measurements {
+			h.deviceDB.TouchTag(m.Tag)
+		}
+	}
 	h.dataMutex.Lock()
 	defer h.dataMutex.Unlock()
+	for _, m := range measurements {
+		h.addMeasurement(m)
+	}
+}
 
-	for _, ts := range h.data {
-		if ts.Tag == uniqueID {
-			ts.Values = append(ts.Values, string(payload))
-			ts.Timestamps = append(ts.Timestamps, timestamp)
-			log.Tracef("exists %s (%v) %v", uniqueID, len(ts.Values), ts.Values)
-			//log.Tracef("exists %s (%v) %v", uniqueID, ts.Values, ts.Timestamps)
+func (h *TimeseriesHandler) processConfigAck(name string, payload string) {
+	logFields := log.Fields{"fnct": "processConfigAck", "device": name}
+	version, err := parseConfigAck(payload)
+	if err != nil {
+		log.WithFields(logFields).Errorf("%v", err)
+		return
+	}
+	if h.deviceDB == nil {
+		return
+	}
+	if err := h.deviceDB.SetAppliedConfigVersion(name, version); err != nil {
+		log.WithFields(logFields).Errorf("Failed to save applied config version: %v", err)
+	}
+}
 
+// addMeasurement appends to the buffered data of the tag. Callers hold the
+// dataMutex.
+func (h *TimeseriesHandler) addMeasurement(m mqttMeasurement) {
+	for _, ts := range h.data {
+		if ts.Tag == m.Tag {
+			ts.Values = append(ts.Values, m.Value)
+			ts.Timestamps = append(ts.Timestamps, m.Timestamp)
+			ts.Comments = append(ts.Comments, m.Comment)
+			log.Tracef("exists %s (%v) %v", m.Tag, len(ts.Values), ts.Values)
 			return
 		}
 	}
 
-	log.Tracef("new %s", uniqueID)
+	log.Tracef("new %s", m.Tag)
 	h.data = append(h.data, &timeseries.TimeseriesImportStruct{
-		Tag:        uniqueID,
-		Values:     []string{string(payload)},
-		Timestamps: []string{timestamp},
+		Tag:        m.Tag,
+		Values:     []string{m.Value},
+		Timestamps: []string{m.Timestamp},
+		Comments:   []string{m.Comment},
 	})
 }
 
+func (h *TimeseriesHandler) bufferedPoints() int {
+	h.dataMutex.Lock()
+	defer h.dataMutex.Unlock()
+	points := 0
+	for _, ts := range h.data {
+		points += len(ts.Values)
+	}
+	return points
+}
+
 func (h *TimeseriesHandler) getAndClearData() ([]timeseries.TimeseriesImportStruct, error) {
 	h.dataMutex.Lock()
 	defer h.dataMutex.Unlock()
@@ -101,12 +172,15 @@ func (h *TimeseriesHandler) getAndClearData() ([]timeseries.TimeseriesImportStru
 
 		var values []string
 		values = append(values, impstr.Values...)
+		var comments []string
+		comments = append(comments, impstr.Comments...)
 		log.Infof("copied %d/%d entries", len(impstr.Values), len(impstr.Timestamps))
 
 		returnData = append(returnData, timeseries.TimeseriesImportStruct{
 			Tag:        impstr.Tag,
 			Timestamps: timestamps,
 			Values:     values,
+			Comments:   comments,
 		})
 	}
 	log.Info("Clear slice")
@@ -115,155 +189,286 @@ func (h *TimeseriesHandler) getAndClearData() ([]timeseries.TimeseriesImportStru
 	return returnData, nil
 }
 
-func sub(client mqtt.Client, topic string) {
+func sub(client mqtt.Client, topic string) error {
 	token := client.Subscribe(topic, 1, nil)
-	for !token.Wait() {
-		time.Sleep(time.Second * 1)
-		fmt.Printf("Waiting for topic: %s", topic)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("subscribing to %s timed out", topic)
 	}
+	return token.Error()
 }
 
+func NewMQTTEdge(port int, config IoTConfig) *MQTTEdge {
+	return &MQTTEdge{
+		Port:   port,
+		config: config,
+	}
+}
+
+// StartMQTTBroker runs the broker until the process exits. Use NewMQTTEdge
+// to be able to stop it.
 func StartMQTTBroker(port int, config IoTConfig) {
-	dbConfig := config.DbConfig
-	logFields := log.Fields{"tech": "mqtt", "fnct": "StartMQTTBroker"}
-	log.WithFields(logFields).Infof("start mqtt broker on port %d", port)
-	fmt.Printf("start mqtt broker on port %d\n", port)
-	handler := TimeseriesHandler{
-		data:      []*timeseries.TimeseriesImportStruct{},
-		dataMutex: &sync.Mutex{},
-	}
-	mqttEdge := MQTTEdge{
-		MQTTserver:        mqttserver.NewServer(nil),
-		timeseriesHandler: &handler,
+	if err := NewMQTTEdge(port, config).Start(context.Background()); err != nil {
+		log.WithFields(log.Fields{"tech": "mqtt", "fnct": "StartMQTTBroker"}).Fatal(err)
 	}
-	go func() {
+}
 
-		tcp := listeners.NewTCP("mqtt-broker", fmt.Sprintf(":%d", port))
+// Start runs the broker until ctx is cancelled or Stop is called. Buffered
+// data is written to the database before it returns.
+func (m *MQTTEdge) Start(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.done != nil {
+		m.mutex.Unlock()
+		return fmt.Errorf("mqtt broker already started")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	m.mutex.Unlock()
+	defer close(m.done)
+	defer cancel()
+
+	config := m.config
+	logFields := log.Fields{"tech": "mqtt", "fnct": "Start"}
+	log.WithFields(logFields).Infof("start mqtt broker on port %d", m.Port)
+	fmt.Printf("start mqtt broker on port %d\n", m.Port)
+	m.deviceDB = GetDeviceDB(config.DbConfig)
+	mapper, err := newTopicMapper(config.TopicMappings)
+	if err != nil {
+		return fmt.Errorf("invalid topic mapping: %v", err)
+	}
+	m.timeseriesHandler = &TimeseriesHandler{
+		data:        []*timeseries.TimeseriesImportStruct{},
+		dataMutex:   &sync.Mutex{},
+		deviceDB:    m.deviceDB,
+		topicMapper: mapper,
+	}
 
-		err := mqttEdge.MQTTserver.AddListener(tcp, nil)
-		if err != nil {
-			log.WithFields(logFields).Fatal(err)
+	var listenerConfig *listeners.Config
+	var auth *mqttAuth
+	if config.MQTTAuth {
+		if config.MQTTUser == "" || config.MQTTPassword == "" {
+			return fmt.Errorf("MQTTAuth requires MQTTUser and MQTTPassword for the server's own client")
 		}
-
-		err = mqttEdge.MQTTserver.Serve()
+		auth = newMQTTAuth(m.deviceDB, config, mapper)
+		listenerConfig = &listeners.Config{Auth: auth}
+	}
+	var listener listeners.Listener = listeners.NewTCP("mqtt-broker", fmt.Sprintf(":%d", m.Port))
+	var certListener *tlsListener
+	if config.MQTTTLS.Enabled() {
+		tlsConfig, err := config.MQTTTLS.Load()
 		if err != nil {
-			log.WithFields(logFields).Fatal(err)
+			return fmt.Errorf("failed to load MQTT TLS config: %v", err)
 		}
-	}()
-
-	var broker = "localhost"
-	fmt.Printf("tcp://%s:%d\n", broker, port)
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", broker, port))
-	opts.SetClientID("mqtt-pinger")
-	//opts.SetUsername("user")
-	//opts.SetPassword("pw")
-
-	opts.SetDefaultPublishHandler(mqttEdge.timeseriesHandler.handleMessage)
-	opts.OnConnect = mqttEdge.timeseriesHandler.handleConnected
-	opts.OnConnectionLost = mqttEdge.timeseriesHandler.handleConnectionLost
-	databaseClient := mqtt.NewClient(opts)
-	time.Sleep(time.Second * 2)
-	if token := databaseClient.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	}
-	// subscribes to everything
-	sub(databaseClient, "+/+/+/+/+/+/data")
-	sub(databaseClient, "+/+/+/+/+/data")
-	sub(databaseClient, "+/+/+/+/data")
-	sub(databaseClient, "+/+/+/data")
-	sub(databaseClient, "+/+/data")
-	sub(databaseClient, "+/data")
-	go publishPing(databaseClient, "/server/ping/data")
-
-	nextUploadTime := time.Now().Add(time.Second * time.Duration(config.UploadInterval))
-	dbh := timeseries.DBHandler(dbConfig)
-	for {
-		dur := time.Until(nextUploadTime)
-		<-time.After(dur)
-		nextUploadTime = time.Now().Add(time.Second * 30)
-		data, err := handler.getAndClearData()
-		if err != nil {
-			log.Errorf("Failed to get and clear data %v", err)
-			continue
+		certListener = newTLSListener("mqtt-broker", fmt.Sprintf(":%d", m.Port), tlsConfig)
+		listener = certListener
+	}
+	m.MQTTserver = mqttserver.NewServer(nil)
+	if auth != nil {
+		m.MQTTserver.Events.OnProcessMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+			device := string(cl.Username)
+			if name, ok := certListener.commonName(cl.Remote); ok {
+				device = name
+			}
+			if !auth.CheckPublish(device, pk.TopicName, pk.Payload, time.Now()) {
+				return pk, mqttserver.ErrRejectPacket
+			}
+			return pk, nil
 		}
-		log.WithFields(logFields).Infof("Got data %d", len(data))
+	}
+	if err := m.MQTTserver.AddListener(listener, listenerConfig); err != nil {
+		return err
+	}
+	if err := m.MQTTserver.Serve(); err != nil {
+		return err
+	}
+	defer m.MQTTserver.Close()
 
-		if len(config.MQTTRedirectAddress) <= 0 {
-			insertData(dbh, data, nextUploadTime, config.TimeseriesTable)
-		} else {
-			log.WithFields(logFields).Infof("Redirect data to %s", config.MQTTRedirectAddress)
-			go sendData(&data, config.MQTTRedirectAddress)
-		}
+	client, err := m.connectClient()
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+	// subscribes to everything, the topic mapper decides what is stored
+	if err := sub(client, "#"); err != nil {
+		return err
+	}
 
-		time.Sleep(time.Second * 5)
+	var background sync.WaitGroup
+	stop := make(chan struct{})
+	run := func(fn func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			fn()
+		}()
 	}
-}
+	run(func() { publishPing(client, "/server/ping/data", stop) })
 
-func insertData(dbh *timeseries.DbHandler, data []timeseries.TimeseriesImportStruct, nextUploadTime time.Time, table string) error {
-	logger := log.WithFields(log.Fields{"tech": "mqtt", "fnct": "insertData"})
-	for _, tsVal := range data {
-		timeTillNextIncome := time.Until(nextUploadTime)
-		logger.Tracef("timeTillNextIncome: %v", timeTillNextIncome.String())
-		if timeTillNextIncome <= time.Second*2 {
-			logger.Errorln("Too much data, abort")
-			break
+	configs := newConfigPublisher(m.MQTTserver, m.deviceDB)
+	m.deviceDB.OnConfigChange(func(dev Device) {
+		if err := configs.Publish(dev); err != nil {
+			log.WithFields(logFields).Errorf("Failed to publish config of %s: %v", dev.Name, err)
+		}
+	})
+	// the server must not be published to once it is closed
+	defer m.deviceDB.OnConfigChange(nil)
+	if err := configs.Sync(); err != nil {
+		log.WithFields(logFields).Errorf("Failed to publish device configs: %v", err)
+	}
 
+	if len(config.MQTTRedirectAddress) > 0 {
+		m.queue, err = OpenForwardQueue(config.RedirectQueuePath, config.MQTTRedirectAddress,
+			config.MQTTRedirectToken, int64(config.RedirectQueueMaxMB)*1024*1024)
+		if err != nil {
+			close(stop)
+			background.Wait()
+			return fmt.Errorf("failed to open redirect queue: %v", err)
 		}
-		logger.Tracef("insert %d/%d entries for %s ",
-			len(tsVal.Timestamps), len(tsVal.Values), tsVal.Tag)
-		timeOut := time.Now().Add(time.Second * 2)
-
-		for time.Now().Before(timeOut) {
-			err := dbh.InsertTimeseries(tsVal, true, table)
-			if err != nil {
-				logger.Warnf("Failed to insert values into database: %v", err)
-				time.Sleep(time.Millisecond * 50)
-			} else {
-				break
+		defer m.queue.Close()
+		run(func() { m.queue.Run(stop) })
+	}
+	m.alerts = GetAlertEngine(config)
+	run(func() { m.alerts.RunNoDataChecks(stop) })
+	m.writer = newTimeseriesWriter(m.deviceDB, config.TimeseriesTable)
+	m.writer.onWritten = func(data []timeseries.TimeseriesImportStruct) {
+		m.lastFlush.Store(time.Now().UnixNano())
+		// the alerts only see data that was stored
+		for _, ts := range data {
+			m.alerts.EvaluateTimeseries(ts)
+		}
+	}
+	run(func() { m.writer.Run(stop) })
+	m.lastFlush.Store(time.Now().UnixNano())
+	activeBroker.Store(m)
+	defer activeBroker.Store(nil)
+
+	ticker := time.NewTicker(time.Second * time.Duration(config.UploadInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return m.shutdown(client, stop, &background)
+		case <-ticker.C:
+			if err := configs.Sync(); err != nil {
+				log.WithFields(logFields).Errorf("Failed to publish device configs: %v", err)
 			}
+			m.flush()
 		}
 	}
-	return nil
 }
 
-func publishPing(client mqtt.Client, topic string) {
-	for {
-		token := client.Publish(topic, 0, false, "-10")
-		token.Wait()
-		//test
-		//time.Sleep(time.Millisecond * 100)
-		time.Sleep(time.Second * 30)
+// Stop shuts the broker down and waits until the buffered data is written.
+func (m *MQTTEdge) Stop() {
+	m.mutex.Lock()
+	cancel, done := m.cancel, m.done
+	m.mutex.Unlock()
+	if cancel == nil {
+		return
 	}
+	cancel()
+	<-done
 }
 
-func sendData(data *[]timeseries.TimeseriesImportStruct, url string) error {
-	jsonData, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return err
+func (m *MQTTEdge) connectClient() (mqtt.Client, error) {
+	config := m.config
+	var broker = "localhost"
+	scheme := "tcp"
+	if config.MQTTTLS.Enabled() {
+		scheme = "ssl"
+	}
+	fmt.Printf("%s://%s:%d\n", scheme, broker, m.Port)
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("%s://%s:%d", scheme, broker, m.Port))
+	if config.MQTTTLS.Enabled() {
+		// the server's own client only connects to localhost
+		opts.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
 	}
-	//fmt.Printf(string(jsonData))
-	client := http.Client{
-		Timeout: 5 * time.Second,
+	opts.SetClientID("mqtt-pinger")
+	if config.MQTTAuth {
+		opts.SetUsername(config.MQTTUser)
+		opts.SetPassword(config.MQTTPassword)
 	}
-	resp, err := client.Post(url+URISaveTimeseries, "application/json",
-		bytes.NewBuffer(jsonData))
+	opts.SetConnectTimeout(10 * time.Second)
+
+	opts.SetDefaultPublishHandler(m.timeseriesHandler.handleMessage)
+	opts.OnConnect = m.timeseriesHandler.handleConnected
+	opts.OnConnectionLost = m.timeseriesHandler.handleConnectionLost
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("server client failed to connect: %v", token.Error())
+	}
+	return client, nil
+}
 
+// flush hands the buffered data to the writer or, if redirected, to the
+// forward queue.
+func (m *MQTTEdge) flush() {
+	logFields := log.Fields{"tech": "mqtt", "fnct": "flush"}
+	data, err := m.timeseriesHandler.getAndClearData()
 	if err != nil {
-		log.Errorf("Failed to send data: %v", err)
-		return err
+		log.Errorf("Failed to get and clear data %v", err)
+		return
 	}
+	log.WithFields(logFields).Infof("Got data %d", len(data))
 
-	if resp.StatusCode != http.StatusOK {
-		log.Errorf("Failed with status: %s", resp.Status)
-		return fmt.Errorf("failed with status: %s", resp.Status)
+	if m.queue == nil {
+		for i := range data {
+			data[i] = m.deviceDB.ApplySensorOffset(data[i])
+		}
+		m.writer.Add(data)
+		stats := m.writer.Stats()
+		if stats.Pending == 0 && !m.writer.failing.Load() {
+			// nothing to write, the writer only reports actual writes
+			m.lastFlush.Store(time.Now().UnixNano())
+		}
+		log.WithFields(logFields).Infof("Writer: %d points pending, written %d, retried %d, delayed %d, dead letters %d, dropped %d",
+			stats.Pending, stats.Written, stats.Retried, stats.Delayed, stats.DeadLettered, stats.Dropped)
+		return
+	}
+	log.WithFields(logFields).Infof("Redirect data to %s", m.config.MQTTRedirectAddress)
+	if err := m.queue.Enqueue(data); err != nil {
+		log.WithFields(logFields).Errorf("Failed to queue data: %v", err)
+	} else {
+		m.lastFlush.Store(time.Now().UnixNano())
+	}
+	if stats, err := m.queue.Stats(); err == nil {
+		log.WithFields(logFields).Infof("Redirect queue: %d batches (%d bytes), %d dead, sent %d, failed %d, dropped %d",
+			stats.Depth, stats.Bytes, stats.Dead, stats.Sent, stats.Failed, stats.Dropped)
 	}
+}
 
-	respStr, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Error(err)
+// shutdown stops receiving, waits for the background loops and writes what
+// is still buffered.
+func (m *MQTTEdge) shutdown(client mqtt.Client, stop chan struct{}, background *sync.WaitGroup) error {
+	logFields := log.Fields{"tech": "mqtt", "fnct": "shutdown"}
+	log.WithFields(logFields).Info("Shutting down mqtt broker gracefully...")
+	client.Disconnect(250)
+	m.timeseriesHandler.processing.Wait()
+	close(stop)
+	background.Wait()
+	m.flush()
+	if m.queue != nil {
+		// queued data is kept on disk and sent after the next start
+		return nil
+	}
+	if err := m.writer.Flush(mqttFlushTimeout); err != nil {
+		log.WithFields(logFields).Errorf("Failed to write buffered data: %v", err)
+		return err
 	}
-	log.Info(string(respStr))
-	defer resp.Body.Close()
+	log.WithFields(logFields).Info("Buffered data written")
 	return nil
 }
+
+func publishPing(client mqtt.Client, topic string, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+	for {
+		token := client.Publish(topic, 0, false, "-10")
+		token.Wait()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package iotedge
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func checkPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// SetMQTTPassword stores the credentials the device uses to connect to the
+// broker. The username is the device name.
+func (devDB *DeviceDB) SetMQTTPassword(name string, password string) error {
+	logFields := log.Fields{"fnct": "SetMQTTPassword", "device": name}
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+	dev, err := devDB.GetDevice(name)
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := devDB.ExecuteQuery("UPDATE devices SET mqtt_password = ? WHERE id = ?", hash, dev.ID); err != nil {
+		log.WithFields(logFields).Errorf("exec failed: %v", err)
+		return err
+	}
+	log.WithFields(logFields).Infof("Updated MQTT password")
+	return nil
+}
+
+func (devDB *DeviceDB) CheckMQTTPassword(name string, password string) bool {
+	logFields := log.Fields{"fnct": "CheckMQTTPassword", "device": name}
+	rows, err := devDB.ExecuteQuery("SELECT mqtt_password FROM devices WHERE name = ?", name)
+	if err != nil {
+		log.WithFields(logFields).Errorf("query failed: %v", err)
+		return false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false
+	}
+	var hash *string
+	if err := rows.Scan(&hash); err != nil || hash == nil {
+		return false
+	}
+	return checkPassword(*hash, password)
+}
+
+// denyLogInterval is how often refusals of the same device are written to
+// the logs table, a misconfigured device retries every few seconds.
+const denyLogInterval = time.Minute
+
+// maxDenyLogDevices bounds the devices whose last refusal is remembered,
+// the names come from unauthenticated clients.
+const maxDenyLogDevices = 10000
+
+// denyLogBurst and denyLogRefill limit the refusals of all devices together.
+const (
+	denyLogBurst  = 20
+	denyLogRefill = 6 * time.Second
+)
+
+// mqttAuth lets the server's own client do everything while devices log in
+// with their name and may only use topics below "<name>/". Below
+// "devices/<name>/" they may read their config and publish the ack. The
+// data they publish may only carry their own sensors.
+type mqttAuth struct {
+	deviceDB *DeviceDB
+	// opened before clients connect, refusals are logged while they publish
+	loggingDB     *LoggingDB
+	topicMapper   *topicMapper
+	adminUser     string
+	adminPassword string
+
+	// deviceIDs caches the IDs of the publishing devices for
+	// sensorCacheTTL, data is checked on every publish
+	deviceMutex sync.Mutex
+	deviceIDs   map[string]cachedDeviceID
+
+	denyMutex  sync.Mutex
+	lastDenied map[string]time.Time
+	suppressed map[string]int
+	denyBucket tokenBucket
+}
+
+type cachedDeviceID struct {
+	id       int
+	loadedAt time.Time
+}
+
+func newMQTTAuth(devDB *DeviceDB, config IoTConfig, mapper *topicMapper) *mqttAuth {
+	return &mqttAuth{
+		deviceDB:      devDB,
+		loggingDB:     GetLoggingDB(config.DbConfig),
+		topicMapper:   mapper,
+		adminUser:     config.MQTTUser,
+		adminPassword: config.MQTTPassword,
+		deviceIDs:     map[string]cachedDeviceID{},
+		lastDenied:    map[string]time.Time{},
+		suppressed:    map[string]int{},
+		denyBucket:    tokenBucket{burst: denyLogBurst, refill: denyLogRefill},
+	}
+}
+
+func (a *mqttAuth) isAdmin(user []byte) bool {
+	return a.adminUser != "" && string(user) == a.adminUser
+}
+
+func (a *mqttAuth) Authenticate(user, password []byte) bool {
+	if a.isAdmin(user) {
+		if a.adminPassword != "" && subtle.ConstantTimeCompare(password, []byte(a.adminPassword)) == 1 {
+			return true
+		}
+	} else if len(user) > 0 && a.deviceDB.CheckMQTTPassword(string(user), string(password)) {
+		return true
+	}
+	a.deny(string(user), "MQTT connection refused: invalid credentials")
+	return false
+}
+
+func (a *mqttAuth) ACL(user []byte, topic string, write bool) bool {
+	if a.isAdmin(user) {
+		return true
+	}
+	name := string(user)
+	if name != "" && strings.HasPrefix(topic, deviceTopicPrefix) {
+		// the config topics are published by the server only, even for a
+		// device named like them
+		if !write && strings.HasPrefix(topic, deviceTopicPrefix+name+"/") {
+			return true
+		}
+		if write && topic == deviceConfigAckTopic(name) {
+			return true
+		}
+	} else if name != "" && strings.HasPrefix(topic, name+"/") {
+		return true
+	}
+	action := "subscribe to"
+	if write {
+		action = "publish on"
+	}
+	a.deny(name, fmt.Sprintf("MQTT access denied: %s %s", action, topic))
+	return false
+}
+
+// CheckPublish tells whether the device may store the data it published.
+// The ACL only checks the topic, the tags also depend on the topic mappings
+// and the payload, so every tag must be a sensor of the device.
+func (a *mqttAuth) CheckPublish(device string, topic string, payload []byte, now time.Time) bool {
+	if a.isAdmin([]byte(device)) {
+		return true
+	}
+	tag, ok := a.topicMapper.Tag(topic)
+	if !ok {
+		return true
+	}
+	measurements, err := parseMQTTPayload(tag, string(payload), now)
+	if err != nil {
+		// refused by processData anyway
+		return true
+	}
+	deviceID, err := a.deviceID(device, now)
+	if errors.Is(err, ErrDeviceNotFound) {
+		a.deny(device, fmt.Sprintf("MQTT data refused: unknown device on %s", topic))
+		return false
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"fnct": "CheckPublish", "device": device}).Errorf("getting device failed: %v", err)
+		return false
+	}
+	for _, m := range measurements {
+		own, err := a.deviceDB.SensorOfDevice(m.Tag, deviceID)
+		if err != nil {
+			log.WithFields(log.Fields{"fnct": "CheckPublish", "device": device}).Errorf("getting sensor failed: %v", err)
+			return false
+		}
+		if !own {
+			a.deny(device, fmt.Sprintf("MQTT data refused: %s is no sensor of the device", m.Tag))
+			return false
+		}
+	}
+	return true
+}
+
+func (a *mqttAuth) deviceID(name string, now time.Time) (int, error) {
+	a.deviceMutex.Lock()
+	defer a.deviceMutex.Unlock()
+	if cached, ok := a.deviceIDs[name]; ok && now.Sub(cached.loadedAt) < sensorCacheTTL {
+		return cached.id, nil
+	}
+	dev, err := a.deviceDB.GetDevice(name)
+	if err != nil {
+		return 0, err
+	}
+	a.deviceIDs[name] = cachedDeviceID{id: dev.ID, loadedAt: now}
+	return dev.ID, nil
+}
+
+func (a *mqttAuth) deny(device string, text string) {
+	logger := log.WithFields(log.Fields{"fnct": "mqttAuth", "device": device})
+	logger.Warnln(text)
+	suppressed, ok := a.mayLogDenied(device, time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		text = fmt.Sprintf("%s (%d more refused)", text, suppressed)
+	}
+	msg := LogMessage{Device: device, Text: text, Level: Warning}
+	if err := a.loggingDB.InsertLogMessage(msg); err != nil {
+		logger.Errorf("failed to log message to DB:%v", err)
+	}
+}
+
+// mayLogDenied limits the refusals written to the logs table to one per
+// device and denyLogInterval, and to denyLogBurst rows plus one per
+// denyLogRefill across all devices, since unauthenticated clients can use
+// any name. It returns how many refusals of the device were left out since.
+func (a *mqttAuth) mayLogDenied(device string, now time.Time) (int, bool) {
+	a.denyMutex.Lock()
+	defer a.denyMutex.Unlock()
+	if last, ok := a.lastDenied[device]; ok && now.Sub(last) < denyLogInterval {
+		a.suppressed[device]++
+		return 0, false
+	}
+	if !a.denyBucket.take(now) {
+		if _, ok := a.lastDenied[device]; ok {
+			a.suppressed[device]++
+		}
+		return 0, false
+	}
+	if len(a.lastDenied) >= maxDenyLogDevices {
+		// forget the devices that aren't suppressed anymore
+		for name, last := range a.lastDenied {
+			if now.Sub(last) >= denyLogInterval {
+				delete(a.lastDenied, name)
+				delete(a.suppressed, name)
+			}
+		}
+	}
+	suppressed := a.suppressed[device]
+	delete(a.suppressed, device)
+	if len(a.lastDenied) < maxDenyLogDevices {
+		a.lastDenied[device] = now
+	}
+	return suppressed, true
+}
+
+// tokenBucket allows burst events at once and one more every refill.
+type tokenBucket struct {
+	burst    int
+	refill   time.Duration
+	tokens   float64
+	filledAt time.Time
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	if b.filledAt.IsZero() {
+		b.tokens = float64(b.burst)
+	} else if elapsed := now.Sub(b.filledAt); elapsed > 0 {
+		b.tokens = min(float64(b.burst), b.tokens+float64(elapsed)/float64(b.refill))
+	}
+	b.filledAt = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
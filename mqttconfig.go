@@ -0,0 +1,212 @@
+package iotedge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	mqttserver "github.com/mochi-co/mqtt/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// Devices subscribe to devices/<name>/config and publish the version they
+// applied to devices/<name>/config/ack.
+const (
+	deviceTopicPrefix   = "devices/"
+	configTopicSuffix   = "/config"
+	configAckTopicLevel = "/ack"
+)
+
+func deviceConfigTopic(name string) string {
+	return deviceTopicPrefix + name + configTopicSuffix
+}
+
+func deviceConfigAckTopic(name string) string {
+	return deviceConfigTopic(name) + configAckTopicLevel
+}
+
+// parseConfigTopic returns the device of a config or config ack topic.
+func parseConfigTopic(topic string) (name string, ack bool, ok bool) {
+	rest, found := strings.CutPrefix(topic, deviceTopicPrefix)
+	if !found {
+		return "", false, false
+	}
+	rest, ack = strings.CutSuffix(rest, configAckTopicLevel)
+	name, found = strings.CutSuffix(rest, configTopicSuffix)
+	if !found || name == "" || strings.Contains(name, "/") {
+		return "", false, false
+	}
+	return name, ack, true
+}
+
+// configHook lets the broker publish configurations that are changed in the
+// same process right away.
+type configHook struct {
+	mutex    sync.Mutex
+	onChange func(Device)
+}
+
+// OnConfigChange registers fn to be called after Configure or
+// ConfigureSensor succeeded.
+func (devDB *DeviceDB) OnConfigChange(fn func(Device)) {
+	devDB.configHook.mutex.Lock()
+	defer devDB.configHook.mutex.Unlock()
+	devDB.configHook.onChange = fn
+}
+
+func (devDB *DeviceDB) configChanged(deviceID int) {
+	devDB.configHook.mutex.Lock()
+	fn := devDB.configHook.onChange
+	devDB.configHook.mutex.Unlock()
+	if fn == nil {
+		return
+	}
+	dev, err := devDB.getDeviceByID(deviceID)
+	if err != nil {
+		log.WithFields(log.Fields{"fnct": "configChanged", "device": deviceID}).Errorf("Failed to get device: %v", err)
+		return
+	}
+	fn(dev)
+}
+
+func (devDB *DeviceDB) getDeviceByID(id int) (Device, error) {
+	rows, err := devDB.ExecuteQuery("SELECT "+deviceColumns+" FROM devices WHERE id = ?", id)
+	if err != nil {
+		return Device{}, err
+	}
+	defer rows.Close()
+	var dev Device
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return dev, err
+		}
+		return dev, ErrDeviceNotFound
+	}
+	err = scanDevice(rows, &dev)
+	return dev, err
+}
+
+// GetDeviceConfig collects the configuration published to the device.
+func (devDB *DeviceDB) GetDeviceConfig(dev Device) (DeviceConfig, error) {
+	sensors, err := devDB.GetSensors(dev.ID)
+	if err != nil {
+		return DeviceConfig{}, err
+	}
+	config := DeviceConfig{
+		Version:       dev.ConfigVersion,
+		Interval:      dev.Interval,
+		Buffer:        dev.Buffer,
+		SensorOffsets: make(map[string]float32, len(sensors)),
+	}
+	for _, sensor := range sensors {
+		config.SensorOffsets[sensor.Name] = sensor.SensorOffset
+	}
+	return config, nil
+}
+
+// SetAppliedConfigVersion records the configuration version a device
+// acknowledged. Versions the server never published are refused.
+func (devDB *DeviceDB) SetAppliedConfigVersion(name string, version int) error {
+	logFields := log.Fields{"fnct": "SetAppliedConfigVersion", "device": name}
+	dev, err := devDB.GetDevice(name)
+	if err != nil {
+		return err
+	}
+	if version < 0 || version > dev.ConfigVersion {
+		return fmt.Errorf("config version %d of %s is unknown, latest is %d", version, name, dev.ConfigVersion)
+	}
+	if _, err := devDB.ExecuteQuery("UPDATE devices SET config_applied = ? WHERE id = ? AND config_version >= ?", version, dev.ID, version); err != nil {
+		log.WithFields(logFields).Errorf("exec failed: %v", err)
+		return err
+	}
+	log.WithFields(logFields).Infof("Device applied config version %d", version)
+	return nil
+}
+
+// parseConfigAck accepts the plain version number or {"Version": n}.
+func parseConfigAck(payload string) (int, error) {
+	payload = strings.TrimSpace(payload)
+	if version, err := strconv.Atoi(payload); err == nil {
+		return version, nil
+	}
+	var ack struct {
+		Version *int
+	}
+	if err := json.Unmarshal([]byte(payload), &ack); err != nil || ack.Version == nil {
+		return 0, fmt.Errorf("invalid config ack: %s", payload)
+	}
+	return *ack.Version, nil
+}
+
+// configPublisher keeps the retained config topics of all devices up to
+// date.
+type configPublisher struct {
+	server    *mqttserver.Server
+	deviceDB  *DeviceDB
+	mutex     sync.Mutex
+	published map[string]int
+}
+
+func newConfigPublisher(server *mqttserver.Server, devDB *DeviceDB) *configPublisher {
+	return &configPublisher{
+		server:    server,
+		deviceDB:  devDB,
+		published: make(map[string]int),
+	}
+}
+
+// Publish sends the device's configuration unless this version was already
+// published.
+func (p *configPublisher) Publish(dev Device) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if version, ok := p.published[dev.Name]; ok && version == dev.ConfigVersion {
+		return nil
+	}
+	config, err := p.deviceDB.GetDeviceConfig(dev)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := p.server.Publish(deviceConfigTopic(dev.Name), payload, true); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"fnct": "configPublisher.Publish", "device": dev.Name}).Infof(
+		"Published config version %d", config.Version)
+	p.published[dev.Name] = dev.ConfigVersion
+	return nil
+}
+
+// Sync publishes configurations that changed in another process, e.g. by
+// the CLI, and clears the config of deleted devices.
+func (p *configPublisher) Sync() error {
+	devices, err := p.deviceDB.GetDevices()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(devices))
+	for _, dev := range devices {
+		existing[dev.Name] = true
+		if err := p.Publish(dev); err != nil {
+			return err
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name := range p.published {
+		if existing[name] {
+			continue
+		}
+		// an empty retained message removes the retained config
+		if err := p.server.Publish(deviceConfigTopic(name), []byte{}, true); err != nil {
+			return err
+		}
+		delete(p.published, name)
+	}
+	return nil
+}
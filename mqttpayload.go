@@ -0,0 +1,91 @@
+package iotedge
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mqttMeasurement is a single value received on a data topic.
+type mqttMeasurement struct {
+	Tag       string
+	Value     string
+	Timestamp string
+	Comment   string
+}
+
+// jsonPayload is the structured format of newer firmware. One message can
+// carry several sensors, Values maps the sensor name to its value and is
+// stored as tag <topic id><sensor>.
+type jsonPayload struct {
+	Timestamp json.RawMessage    `json:"ts"`
+	Values    map[string]float64 `json:"values"`
+	Tags      []string           `json:"tags"`
+}
+
+// parseMQTTPayload auto-detects a JSON object or a plain number. Values
+// without device timestamp get the receive time.
+func parseMQTTPayload(uniqueID string, payload string, received time.Time) ([]mqttMeasurement, error) {
+	payload = strings.TrimSpace(payload)
+	receivedStr := received.UTC().Format(TimestampFormat)
+	if !strings.HasPrefix(payload, "{") {
+		if _, err := strconv.ParseFloat(payload, 32); err != nil {
+			return nil, fmt.Errorf("not a valid number: %v", payload)
+		}
+		return []mqttMeasurement{{Tag: uniqueID, Value: payload, Timestamp: receivedStr}}, nil
+	}
+
+	var p jsonPayload
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		return nil, fmt.Errorf("invalid JSON payload: %v", err)
+	}
+	if len(p.Values) == 0 {
+		return nil, fmt.Errorf("JSON payload without values")
+	}
+	timestamp := receivedStr
+	if len(p.Timestamp) > 0 {
+		ts, err := parsePayloadTimestamp(p.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		timestamp = ts.Format(TimestampFormat)
+	}
+	comment := strings.Join(p.Tags, ";")
+
+	// sorted for a stable order of the tags
+	names := make([]string, 0, len(p.Values))
+	for name := range p.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	measurements := make([]mqttMeasurement, 0, len(names))
+	for _, name := range names {
+		measurements = append(measurements, mqttMeasurement{
+			Tag:       uniqueID + name,
+			Value:     strconv.FormatFloat(p.Values[name], 'f', -1, 64),
+			Timestamp: timestamp,
+			Comment:   comment,
+		})
+	}
+	return measurements, nil
+}
+
+// parsePayloadTimestamp accepts a timestamp string or unix time in seconds
+// or milliseconds.
+func parsePayloadTimestamp(raw json.RawMessage) (time.Time, error) {
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return ParseTimestamp(str)
+	}
+	var epoch float64
+	if err := json.Unmarshal(raw, &epoch); err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s", string(raw))
+	}
+	if epoch > 1e11 {
+		return time.UnixMilli(int64(epoch)).UTC(), nil
+	}
+	return time.Unix(0, int64(epoch*float64(time.Second))).UTC(), nil
+}
@@ -0,0 +1,81 @@
+package iotedge
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TopicMapping maps topics matching Topic to a tag. Topic levels written as
+// {name} match a single level and can be used in Tag, "+" matches a single
+// level and a trailing "#" any number of levels, e.g.
+// "site/{site}/{device}/{sensor}/data" -> "{device}{sensor}".
+type TopicMapping struct {
+	Topic string
+	Tag   string
+}
+
+type compiledMapping struct {
+	levels []string
+	tag    string
+}
+
+type topicMapper struct {
+	mappings []compiledMapping
+}
+
+func newTopicMapper(mappings []TopicMapping) (*topicMapper, error) {
+	m := &topicMapper{}
+	for _, mapping := range mappings {
+		levels := strings.Split(mapping.Topic, "/")
+		for i, level := range levels {
+			if level == "#" && i != len(levels)-1 {
+				return nil, fmt.Errorf("'#' must be the last level in '%s'", mapping.Topic)
+			}
+		}
+		if mapping.Tag == "" {
+			return nil, fmt.Errorf("mapping for '%s' has no tag", mapping.Topic)
+		}
+		m.mappings = append(m.mappings, compiledMapping{levels: levels, tag: mapping.Tag})
+	}
+	return m, nil
+}
+
+// Tag resolves the tag of a topic. The configured mappings are tried in
+// order, otherwise topics ending with /data use their second-to-last level.
+func (m *topicMapper) Tag(topic string) (string, bool) {
+	splittedTopic := strings.Split(topic, "/")
+	if m != nil {
+		for _, mapping := range m.mappings {
+			if tag, ok := mapping.match(splittedTopic); ok {
+				return tag, true
+			}
+		}
+	}
+	if len(splittedTopic) <= 2 || splittedTopic[len(splittedTopic)-1] != "data" {
+		return "", false
+	}
+	return splittedTopic[len(splittedTopic)-2], true
+}
+
+func (c compiledMapping) match(topic []string) (string, bool) {
+	replacements := []string{}
+	for i, level := range c.levels {
+		if level == "#" {
+			break
+		}
+		if i >= len(topic) {
+			return "", false
+		}
+		switch {
+		case level == "+":
+		case strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}"):
+			replacements = append(replacements, level, topic[i])
+		case level != topic[i]:
+			return "", false
+		}
+	}
+	if c.levels[len(c.levels)-1] != "#" && len(topic) != len(c.levels) {
+		return "", false
+	}
+	return strings.NewReplacer(replacements...).Replace(c.tag), true
+}
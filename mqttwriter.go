@@ -0,0 +1,251 @@
+package iotedge
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+)
+
+type timeseriesInserter interface {
+	InsertTimeseriesBatch(data []timeseries.TimeseriesImportStruct, table string) error
+	InsertDeadLetters(data []timeseries.TimeseriesImportStruct, table string, reason string) error
+}
+
+// maxPendingPoints bounds the memory of the writer while the database is
+// unavailable, the oldest data is dropped beyond it.
+const maxPendingPoints = 1_000_000
+
+// timeseriesWriter writes the MQTT batches in its own goroutine. Batches that
+// can't be written because of the database are kept and retried, so a slow
+// or unavailable database only delays the data. Data that can never be
+// written is moved to the dead letters instead.
+type timeseriesWriter struct {
+	db            timeseriesInserter
+	table         string
+	mutex         sync.Mutex
+	pending       []timeseries.TimeseriesImportStruct
+	pendingPoints int
+	maxPending    int
+	wake          chan struct{}
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	written       atomic.Uint64
+	retried       atomic.Uint64
+	delayed       atomic.Uint64
+	deadLettered  atomic.Uint64
+	dropped       atomic.Uint64
+	// failing is set while the last write attempt failed
+	failing atomic.Bool
+	// onWritten is called with the data of each successful write
+	onWritten func(data []timeseries.TimeseriesImportStruct)
+}
+
+type WriterStats struct {
+	Pending      int    // points waiting to be written
+	Written      uint64 // points written
+	Retried      uint64 // points whose insert failed and was repeated
+	Delayed      uint64 // points carried over to a later write cycle
+	DeadLettered uint64 // invalid points moved to the dead letters
+	Dropped      uint64 // points dropped because too many were pending
+}
+
+func newTimeseriesWriter(db timeseriesInserter, table string) *timeseriesWriter {
+	return &timeseriesWriter{
+		db:         db,
+		table:      table,
+		maxPending: maxPendingPoints,
+		wake:       make(chan struct{}, 1),
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 10 * time.Second,
+	}
+}
+
+// Add hands a batch to the writer without blocking the caller.
+func (w *timeseriesWriter) Add(data []timeseries.TimeseriesImportStruct) {
+	if len(data) == 0 {
+		return
+	}
+	w.mutex.Lock()
+	w.pending = append(w.pending, data...)
+	w.pendingPoints += countPoints(data)
+	w.enforceLimit()
+	w.mutex.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enforceLimit drops the oldest tags until at most maxPending points are
+// pending. The caller holds the mutex.
+func (w *timeseriesWriter) enforceLimit() {
+	logger := log.WithFields(log.Fields{"tech": "mqtt", "fnct": "enforceLimit"})
+	dropped := 0
+	for len(w.pending) > 0 && w.pendingPoints > w.maxPending {
+		points := len(w.pending[0].Values)
+		w.pending = w.pending[1:]
+		w.pendingPoints -= points
+		dropped += points
+	}
+	if dropped > 0 {
+		logger.Errorf("Too many points pending, dropped the oldest %d", dropped)
+		w.dropped.Add(uint64(dropped))
+	}
+}
+
+func (w *timeseriesWriter) take() []timeseries.TimeseriesImportStruct {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	data := w.pending
+	w.pending = nil
+	w.pendingPoints = 0
+	return data
+}
+
+// requeue puts unwritten data in front of what arrived in the meantime.
+func (w *timeseriesWriter) requeue(data []timeseries.TimeseriesImportStruct) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = append(append([]timeseries.TimeseriesImportStruct{}, data...), w.pending...)
+	w.pendingPoints += countPoints(data)
+	w.enforceLimit()
+}
+
+func (w *timeseriesWriter) Stats() WriterStats {
+	w.mutex.Lock()
+	pending := w.pendingPoints
+	w.mutex.Unlock()
+	return WriterStats{
+		Pending:      pending,
+		Written:      w.written.Load(),
+		Retried:      w.retried.Load(),
+		Delayed:      w.delayed.Load(),
+		DeadLettered: w.deadLettered.Load(),
+		Dropped:      w.dropped.Load(),
+	}
+}
+
+func countPoints(data []timeseries.TimeseriesImportStruct) int {
+	points := 0
+	for _, ts := range data {
+		points += len(ts.Values)
+	}
+	return points
+}
+
+// Flush writes the pending data once Run has returned. Failed writes are
+// retried until timeout so a short database outage doesn't lose the data.
+func (w *timeseriesWriter) Flush(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := w.minBackoff
+	for {
+		data := w.take()
+		if len(data) == 0 {
+			return nil
+		}
+		if w.write(data) {
+			backoff = w.minBackoff
+			continue
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("%d points not written", w.Stats().Pending)
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, w.maxBackoff)
+	}
+}
+
+// Run writes pending data until stop is closed.
+func (w *timeseriesWriter) Run(stop <-chan struct{}) {
+	backoff := w.minBackoff
+	for {
+		select {
+		case <-stop:
+			return
+		case <-w.wake:
+		}
+		for {
+			data := w.take()
+			if len(data) == 0 {
+				break
+			}
+			if w.write(data) {
+				backoff = w.minBackoff
+				continue
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, w.maxBackoff)
+		}
+	}
+}
+
+// write inserts the whole batch at once and requeues it on failure. It
+// returns whether the batch was written.
+func (w *timeseriesWriter) write(data []timeseries.TimeseriesImportStruct) bool {
+	logger := log.WithFields(log.Fields{"tech": "mqtt", "fnct": "write"})
+	startTime := time.Now()
+	data = w.dropInvalid(data)
+	if len(data) == 0 {
+		return true
+	}
+	points := uint64(countPoints(data))
+	logger.Tracef("insert %d points of %d tags", points, len(data))
+	err := w.db.InsertTimeseriesBatch(data, w.table)
+	var invalid *InvalidTimeseriesError
+	if errors.As(err, &invalid) {
+		// retrying won't help
+		w.deadLetter(data, err)
+		return true
+	}
+	if err != nil {
+		logger.Warnf("Failed to insert values into database, retry %d points later: %v", points, err)
+		w.retried.Add(points)
+		w.delayed.Add(points)
+		w.requeue(data)
+		w.failing.Store(true)
+		return false
+	}
+	w.written.Add(points)
+	w.failing.Store(false)
+	if w.onWritten != nil {
+		w.onWritten(data)
+	}
+	serverMetrics.observeFlush(time.Since(startTime))
+	logger.Infof("Wrote %d tags in %v", len(data), time.Since(startTime))
+	return true
+}
+
+// dropInvalid moves the tags that can never be written to the dead letters,
+// they would block the other data forever.
+func (w *timeseriesWriter) dropInvalid(data []timeseries.TimeseriesImportStruct) []timeseries.TimeseriesImportStruct {
+	valid := make([]timeseries.TimeseriesImportStruct, 0, len(data))
+	for _, ts := range data {
+		if err := validateTimeseries([]timeseries.TimeseriesImportStruct{ts}); err != nil {
+			w.deadLetter([]timeseries.TimeseriesImportStruct{ts}, err)
+			continue
+		}
+		valid = append(valid, ts)
+	}
+	return valid
+}
+
+func (w *timeseriesWriter) deadLetter(data []timeseries.TimeseriesImportStruct, reason error) {
+	logger := log.WithFields(log.Fields{"tech": "mqtt", "fnct": "deadLetter"})
+	points := uint64(countPoints(data))
+	logger.Errorf("Moving %d points to the dead letters: %v", points, reason)
+	if err := w.db.InsertDeadLetters(data, w.table, reason.Error()); err != nil {
+		logger.Errorf("Failed to store dead letters, %d points are lost: %v", points, err)
+		w.dropped.Add(points)
+		return
+	}
+	w.deadLettered.Add(points)
+}
@@ -0,0 +1,225 @@
+package iotedge
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AggregateAvg  string = "avg"
+	AggregateMin  string = "min"
+	AggregateMax  string = "max"
+	AggregateLast string = "last"
+)
+
+// dbTime scans timestamps from both backends: postgres returns time.Time while
+// sqlite may hand back the stored text.
+type dbTime struct {
+	time.Time
+}
+
+func (t *dbTime) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case time.Time:
+		t.Time = v.UTC()
+		return nil
+	case string:
+		return t.parse(v)
+	case []byte:
+		return t.parse(string(v))
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	}
+	return fmt.Errorf("unsupported timestamp type %T", src)
+}
+
+func (t *dbTime) parse(s string) error {
+	parsed, err := ParseTimestamp(s)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+// ParseTimestamp accepts RFC3339 and the format used for stored timestamps.
+func ParseTimestamp(s string) (time.Time, error) {
+	formats := []string{
+		time.RFC3339Nano,
+		TimestampFormat,
+		"2006-01-02 15:04:05.999999999-07:00",
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02T15:04:05.999999999",
+		"2006-01-02",
+	}
+	for _, f := range formats {
+		if parsed, err := time.Parse(f, s); err == nil {
+			return parsed.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp '%s'", s)
+}
+
+func tagCondition(tags []string) (string, []interface{}) {
+	return matchCondition("tag", tags)
+}
+
+// matchCondition matches column against any of the patterns, "*" is a
+// wildcard.
+func matchCondition(column string, patterns []string) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "*") {
+			conds = append(conds, column+" LIKE ?")
+			args = append(args, strings.ReplaceAll(pattern, "*", "%"))
+		} else {
+			conds = append(conds, column+" = ?")
+			args = append(args, pattern)
+		}
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// QueryTimeseries reads the rows of the given tags within [Start, End). If a
+// bucket size is set the values are downsampled per tag with the aggregate.
+func (devDB *DeviceDB) QueryTimeseries(table string, q TimeseriesQuery) ([]TimeseriesRow, error) {
+	logFields := log.Fields{"fnct": "QueryTimeseries", "tags": q.Tags}
+	log.WithFields(logFields).Infof("Query %s from %v to %v", table, q.Start, q.End)
+	if len(q.Tags) == 0 {
+		return nil, fmt.Errorf("no tag given")
+	}
+	if q.Aggregate == "" {
+		q.Aggregate = AggregateAvg
+	}
+	switch q.Aggregate {
+	case AggregateAvg, AggregateMin, AggregateMax, AggregateLast:
+	default:
+		return nil, fmt.Errorf("unknown aggregate '%s'", q.Aggregate)
+	}
+
+	rows, err := devDB.timeseriesRows(table, q)
+	if err != nil {
+		log.WithFields(logFields).Errorf("query failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []TimeseriesRow{}
+	agg := newBucketAggregator(q.Bucket, q.Aggregate)
+	for rows.Next() {
+		row, err := scanTimeseriesRow(rows)
+		if err != nil {
+			log.WithFields(logFields).Errorf("scan failed: %v", err)
+			return nil, err
+		}
+		if q.Bucket <= 0 {
+			result = append(result, row)
+			continue
+		}
+		if done, ok := agg.add(row); ok {
+			result = append(result, done)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if done, ok := agg.flush(); ok {
+		result = append(result, done)
+	}
+	log.WithFields(logFields).Infof("Found %d rows", len(result))
+	return result, nil
+}
+
+// timeseriesRows selects the raw rows of the tags within [Start, End),
+// sorted by tag and time.
+func (devDB *DeviceDB) timeseriesRows(table string, q TimeseriesQuery) (*sql.Rows, error) {
+	tagCond, args := tagCondition(q.Tags)
+	sqlStr := `SELECT time, tag, value, comment FROM ` + table + `
+		WHERE ` + tagCond + ` AND time >= ? AND time < ?
+		ORDER BY tag, time`
+	args = append(args, q.Start.UTC().Format(TimestampFormat), q.End.UTC().Format(TimestampFormat))
+	rows, err := devDB.ExecuteQuery(sqlStr, args...)
+	if err != nil {
+		serverMetrics.dbError("query")
+		return nil, err
+	}
+	return rows, nil
+}
+
+func scanTimeseriesRow(rows *sql.Rows) (TimeseriesRow, error) {
+	var ts dbTime
+	var comment *string
+	var row TimeseriesRow
+	if err := rows.Scan(&ts, &row.Tag, &row.Value, &comment); err != nil {
+		return row, err
+	}
+	row.Time = ts.Time
+	if comment != nil {
+		row.Comment = *comment
+	}
+	return row, nil
+}
+
+// bucketAggregator downsamples rows sorted by tag and time on the fly so
+// large ranges never have to be kept in memory.
+type bucketAggregator struct {
+	bucket    time.Duration
+	aggregate string
+	current   TimeseriesRow
+	count     int
+	sum       float64
+}
+
+func newBucketAggregator(bucket time.Duration, aggregate string) *bucketAggregator {
+	return &bucketAggregator{bucket: bucket, aggregate: aggregate}
+}
+
+// add returns the finished bucket when row starts a new one.
+func (b *bucketAggregator) add(row TimeseriesRow) (TimeseriesRow, bool) {
+	start := row.Time.Truncate(b.bucket)
+	var done TimeseriesRow
+	finished := false
+	if b.count > 0 && (row.Tag != b.current.Tag || !start.Equal(b.current.Time)) {
+		done, finished = b.flush()
+	}
+	if b.count == 0 {
+		b.current = TimeseriesRow{Time: start, Tag: row.Tag, Value: row.Value}
+		b.sum = row.Value
+		b.count = 1
+		return done, finished
+	}
+	b.count++
+	b.sum += row.Value
+	switch b.aggregate {
+	case AggregateMin:
+		if row.Value < b.current.Value {
+			b.current.Value = row.Value
+		}
+	case AggregateMax:
+		if row.Value > b.current.Value {
+			b.current.Value = row.Value
+		}
+	case AggregateLast:
+		b.current.Value = row.Value
+	}
+	return done, finished
+}
+
+func (b *bucketAggregator) flush() (TimeseriesRow, bool) {
+	if b.count == 0 {
+		return TimeseriesRow{}, false
+	}
+	done := b.current
+	if b.aggregate == AggregateAvg {
+		done.Value = b.sum / float64(b.count)
+	}
+	b.count = 0
+	b.sum = 0
+	return done, true
+}
@@ -0,0 +1,262 @@
+package iotedge
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// maxRemoteWriteBody limits the compressed and the decompressed request.
+	maxRemoteWriteBody    = 32 * 1024 * 1024
+	maxRemoteWriteDecoded = 128 * 1024 * 1024
+)
+
+// Field numbers of prometheus.WriteRequest (remote write 1.0), the
+// messages are decoded with protowire instead of generated code.
+const (
+	writeRequestTimeseries = 1
+	timeseriesLabels       = 1
+	timeseriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64 // in milliseconds
+}
+
+type promSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+func (s promSeries) label(name string) string {
+	for _, l := range s.labels {
+		if l.name == name {
+			return l.value
+		}
+	}
+	return ""
+}
+
+// promSeriesTag names the series with template, {__name__} and the label
+// names are replaced. Without template the tag is written like in PromQL:
+// node_load1{instance="edge:9100",job="node"}.
+func promSeriesTag(template string, series promSeries) string {
+	if template != "" {
+		return expandTagTemplate(template, series.label)
+	}
+	labels := slices.Clone(series.labels)
+	slices.SortFunc(labels, func(a, b promLabel) int { return strings.Compare(a.name, b.name) })
+	var tag strings.Builder
+	tag.WriteString(series.label("__name__"))
+	first := true
+	for _, l := range labels {
+		if l.name == "__name__" {
+			continue
+		}
+		if first {
+			tag.WriteByte('{')
+			first = false
+		} else {
+			tag.WriteByte(',')
+		}
+		tag.WriteString(l.name + "=" + strconv.Quote(l.value))
+	}
+	if !first {
+		tag.WriteByte('}')
+	}
+	return tag.String()
+}
+
+// parseWriteRequest decodes the protobuf of a remote write request.
+func parseWriteRequest(b []byte) ([]promSeries, error) {
+	var series []promSeries
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != writeRequestTimeseries || typ != protowire.BytesType {
+			return nil
+		}
+		s, err := parseTimeSeries(value)
+		if err != nil {
+			return err
+		}
+		series = append(series, s)
+		return nil
+	})
+	return series, err
+}
+
+func parseTimeSeries(b []byte) (promSeries, error) {
+	var s promSeries
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case timeseriesLabels:
+			var l promLabel
+			err := forEachField(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if typ != protowire.BytesType {
+					return nil
+				}
+				switch num {
+				case labelName:
+					l.name = string(value)
+				case labelValue:
+					l.value = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.labels = append(s.labels, l)
+		case timeseriesSamples:
+			var sample promSample
+			err := forEachField(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == sampleValue && typ == protowire.Fixed64Type:
+					v, _ := protowire.ConsumeFixed64(value)
+					sample.value = math.Float64frombits(v)
+				case num == sampleTimestamp && typ == protowire.VarintType:
+					v, _ := protowire.ConsumeVarint(value)
+					sample.timestamp = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.samples = append(s.samples, sample)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// forEachField calls fn with the raw value of every field of the message.
+// Nested messages and strings are passed without their length prefix.
+func forEachField(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var value []byte
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value, b = v, b[n:]
+		} else {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value, b = b[:n], b[n:]
+		}
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promTimeseries converts the series into tags. NaN and infinite samples,
+// which include Prometheus' stale markers, are skipped.
+func promTimeseries(series []promSeries, template string) ([]timeseries.TimeseriesImportStruct, int) {
+	var data []timeseries.TimeseriesImportStruct
+	index := map[string]int{}
+	skipped := 0
+	for _, s := range series {
+		tag := promSeriesTag(template, s)
+		for _, sample := range s.samples {
+			if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) || tag == "" {
+				skipped++
+				continue
+			}
+			i, ok := index[tag]
+			if !ok {
+				i = len(data)
+				index[tag] = i
+				data = append(data, timeseries.TimeseriesImportStruct{Tag: tag})
+			}
+			data[i].Timestamps = append(data[i].Timestamps, time.UnixMilli(sample.timestamp).UTC().Format(TimestampFormat))
+			data[i].Values = append(data[i].Values, strconv.FormatFloat(sample.value, 'f', -1, 64))
+		}
+	}
+	return data, skipped
+}
+
+// RemoteWrite stores the samples of a Prometheus remote_write request
+// (version 1.0, snappy compressed protobuf). The tags are named with
+// RemoteWriteTag of the config.
+func (s *IoTEdge) RemoteWrite(c *gin.Context) {
+	logFields := log.Fields{"fnct": "RemoteWrite"}
+	if contentType := c.GetHeader("Content-Type"); strings.Contains(contentType, "io.prometheus.write.v2") {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "only remote write 1.0 is supported"})
+		return
+	}
+	if encoding := c.GetHeader("Content-Encoding"); encoding != "" && encoding != "snappy" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": fmt.Sprintf("unsupported encoding '%s'", encoding)})
+		return
+	}
+	compressed, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxRemoteWriteBody))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	if n, err := snappy.DecodedLen(compressed); err != nil || n > maxRemoteWriteDecoded {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: invalid snappy block of %d bytes: %v", n, err)})
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+	series, err := parseWriteRequest(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Input error: %v", err)})
+		return
+	}
+
+	data, skipped := promTimeseries(series, s.IoTConfig.RemoteWriteTag)
+	if !s.mayWriteTags(c, importTags(data)) {
+		return
+	}
+	for i, ts := range data {
+		data[i] = s.prepareTimeseries(ts, true)
+	}
+	if err := s.DeviceDB.InsertTimeseriesBatch(data, s.IoTConfig.TimeseriesTable); err != nil {
+		log.WithFields(logFields).Errorf("Failed to save timeseries: %v", err)
+		// 5xx makes Prometheus retry the request, invalid data is refused with 400
+		c.JSON(insertErrorStatus(err), gin.H{"error": fmt.Sprintf("Failed to save timeseries: %v", err)})
+		return
+	}
+	s.evaluateAlerts(data)
+	log.WithFields(logFields).Infof("Stored %d series, skipped %d samples", len(data), skipped)
+	c.Status(http.StatusNoContent)
+}
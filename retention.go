@@ -0,0 +1,208 @@
+package iotedge
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RetentionPolicy deletes the rows of Table that are older than MaxAge, e.g.
+// "90d" or "12h". With Tag only matching tags (devices for the logs table)
+// are deleted, "*" is a wildcard. A policy with Tag takes precedence over
+// the policy without tag of the same table, of several policies with
+// matching Tag the first one applies.
+type RetentionPolicy struct {
+	Table  string
+	Tag    string
+	MaxAge string
+}
+
+type PruneResult struct {
+	Policy RetentionPolicy
+	Before time.Time
+	Rows   int64 // rows deleted or, on a dry run, to be deleted
+}
+
+// parseMaxAge accepts Go durations and additionally days like "30d".
+func parseMaxAge(s string) (time.Duration, error) {
+	var maxAge time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid max age '%s'", s)
+		}
+		maxAge = time.Duration(n * float64(24*time.Hour))
+	} else {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid max age '%s'", s)
+		}
+		maxAge = d
+	}
+	if maxAge <= 0 {
+		return 0, fmt.Errorf("max age '%s' must be positive", s)
+	}
+	return maxAge, nil
+}
+
+// ValidateRetention checks the policies, only the timeseries table, its
+// rollup tables and the logs table may be pruned.
+func ValidateRetention(policies []RetentionPolicy, timeseriesTable string) error {
+	tables := []string{timeseriesTable, "logs"}
+	for name := range rollupIntervals {
+		tables = append(tables, RollupTable(timeseriesTable, name))
+	}
+	for _, p := range policies {
+		if !slices.Contains(tables, p.Table) {
+			return fmt.Errorf("invalid retention table '%s', allowed are %v", p.Table, tables)
+		}
+		if _, err := parseMaxAge(p.MaxAge); err != nil {
+			return fmt.Errorf("retention of %s: %w", p.Table, err)
+		}
+	}
+	return nil
+}
+
+// retentionColumns returns the time column and the column Tag is matched
+// against.
+func retentionColumns(table string) (string, string) {
+	if table == "logs" {
+		return "timestamp", "device"
+	}
+	return "time", "tag"
+}
+
+// precedingTags returns the tag patterns of the same table which take
+// precedence over policy i.
+func precedingTags(policies []RetentionPolicy, i int) []string {
+	var tags []string
+	for j, p := range policies {
+		if p.Table != policies[i].Table || p.Tag == "" || j == i {
+			continue
+		}
+		if policies[i].Tag == "" || j < i {
+			tags = append(tags, p.Tag)
+		}
+	}
+	return tags
+}
+
+// Prune deletes the rows that are older than their policy allows. With
+// dryRun the rows are only counted. timeseriesTable limits the tables the
+// policies may name, see ValidateRetention.
+func (devDB *DeviceDB) Prune(timeseriesTable string, policies []RetentionPolicy, now time.Time, dryRun bool) ([]PruneResult, error) {
+	logFields := log.Fields{"fnct": "Prune", "dryRun": dryRun}
+	if err := ValidateRetention(policies, timeseriesTable); err != nil {
+		return nil, err
+	}
+	results := []PruneResult{}
+	for i, p := range policies {
+		maxAge, _ := parseMaxAge(p.MaxAge)
+		before := now.Add(-maxAge)
+		timeCol, tagCol := retentionColumns(p.Table)
+		conds := []string{timeCol + " < ?"}
+		args := []interface{}{before.UTC().Format(TimestampFormat)}
+		if p.Tag != "" {
+			cond, tagArgs := matchCondition(tagCol, []string{p.Tag})
+			conds = append(conds, cond)
+			args = append(args, tagArgs...)
+		}
+		if tags := precedingTags(policies, i); len(tags) > 0 {
+			cond, tagArgs := matchCondition(tagCol, tags)
+			conds = append(conds, "NOT "+cond)
+			args = append(args, tagArgs...)
+		}
+		where := strings.Join(conds, " AND ")
+
+		var count int64
+		var err error
+		if dryRun {
+			count, err = devDB.countRows(p.Table, where, args)
+		} else {
+			count, err = devDB.deleteRows(p.Table, where, args)
+			if err != nil {
+				log.WithFields(logFields).Errorf("Failed to prune %s: %v", p.Table, err)
+				serverMetrics.dbError("prune")
+			} else if count > 0 {
+				log.WithFields(logFields).Infof("Deleted %d rows of %s older than %v", count, p.Table, before)
+			}
+		}
+		if err != nil {
+			return results, err
+		}
+		results = append(results, PruneResult{Policy: p, Before: before, Rows: count})
+	}
+	return results, nil
+}
+
+func (devDB *DeviceDB) countRows(table string, where string, args []interface{}) (int64, error) {
+	rows, err := devDB.ExecuteQuery("SELECT COUNT(*) FROM "+table+" WHERE "+where, args...)
+	if err != nil {
+		serverMetrics.dbError("query")
+		return 0, fmt.Errorf("failed to count rows of %s: %w", table, err)
+	}
+	defer rows.Close()
+	var count int64
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			return 0, err
+		}
+	}
+	return count, rows.Err()
+}
+
+// deleteRows returns the number of rows deleted, ExecuteQuery doesn't
+// report it.
+func (devDB *DeviceDB) deleteRows(table string, where string, args []interface{}) (int64, error) {
+	tx, err := beginTx(devDB.conf)
+	if err != nil {
+		return 0, err
+	}
+	// no-op once committed
+	defer tx.Rollback()
+	result, err := tx.Exec(tx.rebind("DELETE FROM "+table+" WHERE "+where), args...)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// Prune applies the retention policies of the config.
+func (s *IoTEdge) Prune(dryRun bool) ([]PruneResult, error) {
+	// the logs table is created with the logging DB
+	GetLoggingDB(s.IoTConfig.DbConfig)
+	return s.DeviceDB.Prune(s.IoTConfig.TimeseriesTable, s.IoTConfig.Retention, time.Now(), dryRun)
+}
+
+// RunRetention prunes every RetentionInterval until stop is closed.
+func (s *IoTEdge) RunRetention(stop <-chan struct{}) {
+	logFields := log.Fields{"fnct": "RunRetention"}
+	// validated by New
+	if len(s.IoTConfig.Retention) == 0 {
+		return
+	}
+	interval := time.Duration(s.IoTConfig.RetentionInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Prune(false); err != nil {
+			log.WithFields(logFields).Errorf("Pruning failed: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
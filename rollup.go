@@ -0,0 +1,239 @@
+package iotedge
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rollupIntervals are the supported rollups. The rollup tables are named
+// <table>_<rollup> and have the columns time, tag, min, max, avg and count.
+var rollupIntervals = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+}
+
+type rollup struct {
+	table    string
+	interval time.Duration
+}
+
+// rollupRegistry holds the rollups maintained per raw table.
+type rollupRegistry struct {
+	mutex  sync.RWMutex
+	tables map[string][]rollup
+}
+
+type rollupKey struct {
+	time time.Time
+	tag  string
+}
+
+type rollupBucket struct {
+	min   float64
+	max   float64
+	sum   float64
+	count int64
+}
+
+type insertedPoint struct {
+	time  time.Time
+	tag   string
+	value float64
+}
+
+type BackfillResult struct {
+	Table   string
+	Buckets int64 // buckets of the backfilled range
+}
+
+func RollupTable(table string, name string) string {
+	return table + "_" + name
+}
+
+// EnableRollups creates the rollup tables of table, InsertTimeseriesBatch
+// keeps them up to date from then on.
+func (devDB *DeviceDB) EnableRollups(table string, names []string) error {
+	var rollups []rollup
+	for _, name := range names {
+		interval, ok := rollupIntervals[name]
+		if !ok {
+			return fmt.Errorf("unknown rollup '%s'", name)
+		}
+		r := rollup{table: RollupTable(table, name), interval: interval}
+		sqlStr := `CREATE TABLE IF NOT EXISTS ` + r.table + ` (
+			time  ` + devDB.timestampType() + ` NOT NULL,
+			tag   TEXT NOT NULL,
+			min   DOUBLE PRECISION,
+			max   DOUBLE PRECISION,
+			avg   DOUBLE PRECISION,
+			count BIGINT,
+			PRIMARY KEY (time, tag)
+		)`
+		rows, err := devDB.ExecuteQuery(sqlStr)
+		if err != nil {
+			return fmt.Errorf("failed to create rollup table %s: %w", r.table, err)
+		}
+		rows.Close()
+		rollups = append(rollups, r)
+	}
+	devDB.rollups.mutex.Lock()
+	defer devDB.rollups.mutex.Unlock()
+	if devDB.rollups.tables == nil {
+		devDB.rollups.tables = make(map[string][]rollup)
+	}
+	devDB.rollups.tables[table] = rollups
+	return nil
+}
+
+func (devDB *DeviceDB) rollupsOf(table string) []rollup {
+	devDB.rollups.mutex.RLock()
+	defer devDB.rollups.mutex.RUnlock()
+	return devDB.rollups.tables[table]
+}
+
+// scanInserted reads the rows returned by the INSERT and returns their
+// number. Values that aren't numbers are left out of the rollups.
+func scanInserted(rows *sql.Rows) ([]insertedPoint, int, error) {
+	var points []insertedPoint
+	n := 0
+	for rows.Next() {
+		var ts dbTime
+		var tag string
+		var value *string
+		if err := rows.Scan(&ts, &tag, &value); err != nil {
+			return points, n, err
+		}
+		n++
+		if value == nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(*value, 64)
+		if err != nil {
+			continue
+		}
+		points = append(points, insertedPoint{time: ts.Time, tag: tag, value: v})
+	}
+	return points, n, rows.Err()
+}
+
+func aggregateRollup(points []insertedPoint, interval time.Duration) map[rollupKey]*rollupBucket {
+	buckets := make(map[rollupKey]*rollupBucket)
+	for _, p := range points {
+		key := rollupKey{time: p.time.UTC().Truncate(interval), tag: p.tag}
+		b, ok := buckets[key]
+		if !ok {
+			buckets[key] = &rollupBucket{min: p.value, max: p.value, sum: p.value, count: 1}
+			continue
+		}
+		b.min = min(b.min, p.value)
+		b.max = max(b.max, p.value)
+		b.sum += p.value
+		b.count++
+	}
+	return buckets
+}
+
+// updateRollups merges newly inserted points into the rollup tables within
+// the transaction of the INSERT. Only rows the INSERT actually wrote are
+// passed, so repeated batches aren't counted twice.
+func (devDB *DeviceDB) updateRollups(tx *dbTx, rollups []rollup, points []insertedPoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	minFn, maxFn := "MIN", "MAX"
+	if devDB.conf.UsePostgres {
+		minFn, maxFn = "LEAST", "GREATEST"
+	}
+	for _, r := range rollups {
+		buckets := aggregateRollup(points, r.interval)
+		keys := make([]rollupKey, 0, len(buckets))
+		for key := range buckets {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].tag != keys[j].tag {
+				return keys[i].tag < keys[j].tag
+			}
+			return keys[i].time.Before(keys[j].time)
+		})
+		for start := 0; start < len(keys); start += batchRows {
+			chunk := keys[start:min(start+batchRows, len(keys))]
+			var args []interface{}
+			for _, key := range chunk {
+				b := buckets[key]
+				args = append(args, key.time.Format(TimestampFormat), key.tag, b.min, b.max, b.sum/float64(b.count), b.count)
+			}
+			sqlStr := `INSERT INTO ` + r.table + ` (time, tag, min, max, avg, count) VALUES ` +
+				strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?, ?),", len(chunk)), ",") + `
+				ON CONFLICT (time, tag) DO UPDATE SET
+				min = ` + minFn + `(` + r.table + `.min, excluded.min),
+				max = ` + maxFn + `(` + r.table + `.max, excluded.max),
+				avg = (` + r.table + `.avg * ` + r.table + `.count + excluded.avg * excluded.count) /
+					(` + r.table + `.count + excluded.count),
+				count = ` + r.table + `.count + excluded.count`
+			rows, err := tx.ExecuteQuery(sqlStr, args...)
+			if err != nil {
+				serverMetrics.dbError("rollup")
+				return fmt.Errorf("failed to update %s: %w", r.table, err)
+			}
+			rows.Close()
+		}
+	}
+	return nil
+}
+
+// bucketExpression truncates the time column to the rollup interval.
+func (devDB *DeviceDB) bucketExpression(interval time.Duration) string {
+	if devDB.conf.UsePostgres {
+		if interval == time.Hour {
+			return "date_trunc('hour', time)"
+		}
+		return "date_trunc('day', time)"
+	}
+	if interval == time.Hour {
+		return "strftime('%Y-%m-%d %H:00:00.000', time)"
+	}
+	return "strftime('%Y-%m-%d 00:00:00.000', time)"
+}
+
+// BackfillRollups recomputes the rollups of table from the raw rows since
+// the given time, a zero time recomputes everything. Buckets are replaced,
+// so the range should only cover time that isn't pruned yet.
+func (devDB *DeviceDB) BackfillRollups(table string, since time.Time) ([]BackfillResult, error) {
+	logFields := log.Fields{"fnct": "BackfillRollups", "table": table}
+	rollups := devDB.rollupsOf(table)
+	if len(rollups) == 0 {
+		return nil, fmt.Errorf("no rollups enabled for %s", table)
+	}
+	results := []BackfillResult{}
+	for _, r := range rollups {
+		start := since.UTC().Truncate(r.interval).Format(TimestampFormat)
+		bucket := devDB.bucketExpression(r.interval)
+		sqlStr := `INSERT INTO ` + r.table + ` (time, tag, min, max, avg, count)
+			SELECT ` + bucket + `, tag, MIN(value), MAX(value), AVG(value), COUNT(value) FROM ` + table + `
+			WHERE time >= ? AND value IS NOT NULL
+			GROUP BY ` + bucket + `, tag
+			ON CONFLICT (time, tag) DO UPDATE SET
+			min = excluded.min, max = excluded.max, avg = excluded.avg, count = excluded.count`
+		log.WithFields(logFields).Infof("Backfill %s since %s", r.table, start)
+		rows, err := devDB.ExecuteQuery(sqlStr, start)
+		if err != nil {
+			serverMetrics.dbError("rollup")
+			return results, fmt.Errorf("failed to backfill %s: %w", r.table, err)
+		}
+		rows.Close()
+		buckets, err := devDB.countRows(r.table, "time >= ?", []interface{}{start})
+		if err != nil {
+			return results, err
+		}
+		results = append(results, BackfillResult{Table: r.table, Buckets: buckets})
+	}
+	return results, nil
+}
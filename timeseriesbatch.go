@@ -0,0 +1,200 @@
+package iotedge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pat-rohn/timeseries"
+	log "github.com/sirupsen/logrus"
+)
+
+// batchRows limits the rows per statement, sqlite and postgres both cap the
+// number of bind parameters.
+const batchRows = 500
+
+// InvalidTimeseriesError reports data that can't be stored, writing it
+// again won't help.
+type InvalidTimeseriesError struct {
+	Tag    string
+	Reason string
+}
+
+func (e *InvalidTimeseriesError) Error() string {
+	return fmt.Sprintf("tag '%s': %s", e.Tag, e.Reason)
+}
+
+// insertErrorStatus is the HTTP status answering an insert error.
+func insertErrorStatus(err error) int {
+	var invalid *InvalidTimeseriesError
+	if errors.As(err, &invalid) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// validateTimeseries checks all data before anything is written.
+func validateTimeseries(data []timeseries.TimeseriesImportStruct) error {
+	for _, ts := range data {
+		if ts.Tag == "" {
+			return &InvalidTimeseriesError{Reason: "empty tag"}
+		}
+		if len(ts.Timestamps) != len(ts.Values) {
+			return &InvalidTimeseriesError{Tag: ts.Tag,
+				Reason: fmt.Sprintf("%d timestamps but %d values", len(ts.Timestamps), len(ts.Values))}
+		}
+		for i, timestamp := range ts.Timestamps {
+			if _, err := ParseTimestamp(timestamp); err != nil {
+				return &InvalidTimeseriesError{Tag: ts.Tag, Reason: err.Error()}
+			}
+			if _, err := strconv.ParseFloat(ts.Values[i], 64); err != nil {
+				return &InvalidTimeseriesError{Tag: ts.Tag, Reason: fmt.Sprintf("invalid value '%s'", ts.Values[i])}
+			}
+		}
+	}
+	return nil
+}
+
+// InsertTimeseriesBatch writes all tags with multi-row INSERT statements
+// instead of one InsertTimeseries call per tag. The data is validated first,
+// invalid data returns an InvalidTimeseriesError. All statements run in one
+// transaction; rows that already exist are ignored so a failed batch can
+// simply be written again. The rollups of the table are updated with the
+// rows that were actually inserted in the same transaction.
+func (devDB *DeviceDB) InsertTimeseriesBatch(data []timeseries.TimeseriesImportStruct, table string) error {
+	_, err := devDB.insertTimeseriesBatch(data, table, false)
+	return err
+}
+
+// insertTimeseriesBatch returns the number of rows written. With replace
+// existing rows are overwritten instead of ignored. The rollups aren't
+// updated then since replaced values can't be taken out of them.
+func (devDB *DeviceDB) insertTimeseriesBatch(data []timeseries.TimeseriesImportStruct, table string, replace bool) (int, error) {
+	logFields := log.Fields{"fnct": "insertTimeseriesBatch", "table": table}
+	if err := validateTimeseries(data); err != nil {
+		return 0, err
+	}
+	rollups := devDB.rollupsOf(table)
+	if replace {
+		rollups = nil
+	}
+	tx, err := beginTx(devDB.conf)
+	if err != nil {
+		serverMetrics.dbError("insert")
+		return 0, err
+	}
+	// no-op once committed
+	defer tx.Rollback()
+
+	var args []interface{}
+	var inserted []insertedPoint
+	rows := 0
+	written := 0
+	flush := func() error {
+		if rows == 0 {
+			return nil
+		}
+		sqlStr := "INSERT INTO " + table + " (time, tag, value, comment) VALUES " +
+			strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?),", rows), ",")
+		if replace {
+			sqlStr += " ON CONFLICT (time, tag) DO UPDATE SET value = excluded.value, comment = excluded.comment"
+		} else {
+			sqlStr += " ON CONFLICT DO NOTHING"
+		}
+		sqlStr += " RETURNING time, tag, value"
+		result, err := tx.ExecuteQuery(sqlStr, args...)
+		if err != nil {
+			log.WithFields(logFields).Errorf("insert of %d rows failed: %v", rows, err)
+			serverMetrics.dbError("insert")
+			return err
+		}
+		points, n, err := scanInserted(result)
+		result.Close()
+		if err != nil {
+			log.WithFields(logFields).Errorf("reading inserted rows failed: %v", err)
+			serverMetrics.dbError("insert")
+			return err
+		}
+		written += n
+		inserted = append(inserted, points...)
+		args = args[:0]
+		rows = 0
+		return nil
+	}
+
+	for _, ts := range data {
+		for i := range ts.Values {
+			comment := ""
+			if i < len(ts.Comments) {
+				comment = ts.Comments[i]
+			}
+			// validated above, stored in one format since sqlite compares
+			// the timestamps as text
+			timestamp, err := ParseTimestamp(ts.Timestamps[i])
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, timestamp.Format(TimestampFormat), ts.Tag, ts.Values[i], comment)
+			rows++
+			if rows == batchRows {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	// a failed rollup update rolls the rows back as well, so the batch can
+	// be written again without counting it twice
+	if err := devDB.updateRollups(tx, rollups, inserted); err != nil {
+		log.WithFields(logFields).Errorf("rollup update failed: %v", err)
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithFields(logFields).Errorf("commit of %d rows failed: %v", written, err)
+		serverMetrics.dbError("insert")
+		return 0, err
+	}
+	return written, nil
+}
+
+// createDeadLetterTable creates the table for data the MQTT writer couldn't
+// store. The payload is the JSON of the TimeseriesImportStructs.
+func (devDB *DeviceDB) createDeadLetterTable() error {
+	sqlStr := `CREATE TABLE IF NOT EXISTS dead_letters (
+		` + devDB.idColumn() + ` ,
+		created     ` + devDB.timestampType() + ` DEFAULT CURRENT_TIMESTAMP,
+		target      TEXT NOT NULL,
+		reason      TEXT DEFAULT '',
+		payload     TEXT NOT NULL
+	   );
+	 `
+	rows, err := devDB.ExecuteQuery(sqlStr)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// InsertDeadLetters keeps data that can't be written to table, so it can be
+// inspected and repaired instead of being retried forever.
+func (devDB *DeviceDB) InsertDeadLetters(data []timeseries.TimeseriesImportStruct, table string, reason string) error {
+	logFields := log.Fields{"fnct": "InsertDeadLetters", "table": table}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	rows, err := devDB.ExecuteQuery("INSERT INTO dead_letters (target, reason, payload) VALUES (?, ?, ?)",
+		table, reason, string(payload))
+	if err != nil {
+		log.WithFields(logFields).Errorf("insert failed: %v", err)
+		serverMetrics.dbError("dead_letter")
+		return err
+	}
+	return rows.Close()
+}
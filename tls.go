@@ -0,0 +1,186 @@
+package iotedge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/system"
+	log "github.com/sirupsen/logrus"
+)
+
+// TLSConfig enables TLS when CertFile and KeyFile are set. Client
+// certificates signed by ClientCAFile are verified if a client presents one.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+func (c TLSConfig) Load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key pair: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// certAuth is used for connections with a verified client certificate. The
+// device is identified by the certificate's common name instead of the
+// username it sends.
+type certAuth struct {
+	name string
+	next auth.Controller
+}
+
+func (a *certAuth) Authenticate(user, password []byte) bool {
+	return true
+}
+
+func (a *certAuth) ACL(user []byte, topic string, write bool) bool {
+	return a.next.ACL([]byte(a.name), topic, write)
+}
+
+// tlsListener works like listeners.TCP but completes the handshake itself so
+// clients with a certificate get a certAuth controller.
+type tlsListener struct {
+	sync.RWMutex
+	id        string
+	address   string
+	tlsConfig *tls.Config
+	listen    net.Listener
+	config    *listeners.Config
+	end       uint32
+	// commonNames maps the remote address of connected clients to the
+	// common name of their certificate
+	commonNames sync.Map
+}
+
+func newTLSListener(id string, address string, tlsConfig *tls.Config) *tlsListener {
+	return &tlsListener{
+		id:        id,
+		address:   address,
+		tlsConfig: tlsConfig,
+		config:    &listeners.Config{Auth: new(auth.Allow)},
+	}
+}
+
+func (l *tlsListener) SetConfig(config *listeners.Config) {
+	l.Lock()
+	defer l.Unlock()
+	if config != nil {
+		l.config = config
+		if l.config.Auth == nil {
+			l.config.Auth = new(auth.Disallow)
+		}
+	}
+}
+
+func (l *tlsListener) ID() string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.id
+}
+
+func (l *tlsListener) Listen(s *system.Info) error {
+	var err error
+	l.listen, err = tls.Listen("tcp", l.address, l.tlsConfig)
+	return err
+}
+
+func (l *tlsListener) Serve(establish listeners.EstablishFunc) {
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+		conn, err := l.listen.Accept()
+		if err != nil {
+			return
+		}
+		if atomic.LoadUint32(&l.end) == 0 {
+			go func() {
+				_ = establish(l.id, conn, l.connectionAuth(conn))
+				l.commonNames.Delete(conn.RemoteAddr().String())
+			}()
+		}
+	}
+}
+
+func (l *tlsListener) connectionAuth(conn net.Conn) auth.Controller {
+	l.RLock()
+	controller := l.config.Auth
+	l.RUnlock()
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return controller
+	}
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		log.WithFields(log.Fields{"fnct": "connectionAuth"}).Warnf("TLS handshake failed: %v", err)
+		return controller
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 || certs[0].Subject.CommonName == "" {
+		return controller
+	}
+	name := certs[0].Subject.CommonName
+	if a, ok := controller.(*mqttAuth); ok && a.isAdmin([]byte(name)) {
+		log.WithFields(log.Fields{"fnct": "connectionAuth"}).Warnf("Certificate of %s uses the name of the server's client", conn.RemoteAddr())
+		return controller
+	}
+	l.commonNames.Store(conn.RemoteAddr().String(), name)
+	return &certAuth{name: name, next: controller}
+}
+
+// commonName returns the certificate name of the client connected from
+// remote. The listener may be nil.
+func (l *tlsListener) commonName(remote string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	name, ok := l.commonNames.Load(remote)
+	if !ok {
+		return "", false
+	}
+	return name.(string), true
+}
+
+func (l *tlsListener) Close(closeClients listeners.CloseFunc) {
+	l.Lock()
+	defer l.Unlock()
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+	if l.listen != nil {
+		l.listen.Close()
+	}
+}
@@ -0,0 +1,280 @@
+package iotedge
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tokenKindDevice = "device"
+	tokenKindAdmin  = "admin"
+)
+
+// revokedToken is stored instead of the hash of a revoked device token, it
+// can't match the hash of any token.
+const revokedToken = "revoked"
+
+// tokens are random, so a plain hash is enough to keep them out of the DB
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (devDB *DeviceDB) createTokenTables() error {
+	sqlStr := `CREATE TABLE IF NOT EXISTS admin_tokens (
+		` + devDB.idColumn() + ` ,
+		name        TEXT NOT NULL UNIQUE,
+		token_hash  TEXT NOT NULL
+	   );
+	 `
+	if _, err := devDB.ExecuteQuery(sqlStr); err != nil {
+		return err
+	}
+	return devDB.addColumnIfMissing("devices", "api_token", "TEXT")
+}
+
+// IssueDeviceToken creates a new token for the device and replaces the old
+// one. Only the hash is stored, the token can't be read again.
+func (devDB *DeviceDB) IssueDeviceToken(name string) (string, error) {
+	logFields := log.Fields{"fnct": "IssueDeviceToken", "device": name}
+	dev, err := devDB.GetDevice(name)
+	if err != nil {
+		return "", err
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := devDB.ExecuteQuery("UPDATE devices SET api_token = ? WHERE id = ?", hashToken(token), dev.ID); err != nil {
+		log.WithFields(logFields).Errorf("exec failed: %v", err)
+		return "", err
+	}
+	log.WithFields(logFields).Infof("Issued token")
+	return token, nil
+}
+
+func (devDB *DeviceDB) RevokeDeviceToken(name string) error {
+	logFields := log.Fields{"fnct": "RevokeDeviceToken", "device": name}
+	if _, err := devDB.GetDevice(name); err != nil {
+		return err
+	}
+	if _, err := devDB.ExecuteQuery("UPDATE devices SET api_token = ? WHERE name = ?", revokedToken, name); err != nil {
+		log.WithFields(logFields).Errorf("exec failed: %v", err)
+		return err
+	}
+	log.WithFields(logFields).Infof("Revoked token")
+	return nil
+}
+
+// HasDeviceToken tells whether a valid token was issued for the device.
+func (devDB *DeviceDB) HasDeviceToken(name string) (bool, error) {
+	_, hasToken, err := devDB.deviceTokenState(name)
+	return hasToken, err
+}
+
+// deviceTokenState tells whether the device is known and whether it has a
+// valid token.
+func (devDB *DeviceDB) deviceTokenState(name string) (known bool, hasToken bool, err error) {
+	rows, err := devDB.ExecuteQuery("SELECT api_token FROM devices WHERE name = ?", name)
+	if err != nil {
+		return false, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, false, rows.Err()
+	}
+	var hash *string
+	if err := rows.Scan(&hash); err != nil {
+		return false, false, err
+	}
+	return true, hash != nil && *hash != "" && *hash != revokedToken, nil
+}
+
+func (devDB *DeviceDB) IssueAdminToken(name string) (string, error) {
+	logFields := log.Fields{"fnct": "IssueAdminToken", "name": name}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if err := devDB.RevokeAdminToken(name); err != nil {
+		return "", err
+	}
+	if _, err := devDB.ExecuteQuery("INSERT INTO admin_tokens (name, token_hash) VALUES (?, ?)",
+		name, hashToken(token)); err != nil {
+		log.WithFields(logFields).Errorf("exec failed: %v", err)
+		return "", err
+	}
+	log.WithFields(logFields).Infof("Issued admin token")
+	return token, nil
+}
+
+func (devDB *DeviceDB) RevokeAdminToken(name string) error {
+	logFields := log.Fields{"fnct": "RevokeAdminToken", "name": name}
+	if _, err := devDB.ExecuteQuery("DELETE FROM admin_tokens WHERE name = ?", name); err != nil {
+		log.WithFields(logFields).Errorf("exec failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// LookupToken returns the kind of the token and the name of its device or
+// admin. ok is false for unknown tokens.
+func (devDB *DeviceDB) LookupToken(token string) (kind string, name string, ok bool, err error) {
+	hash := hashToken(token)
+	for _, q := range []struct{ kind, sql string }{
+		{tokenKindAdmin, "SELECT name FROM admin_tokens WHERE token_hash = ?"},
+		{tokenKindDevice, "SELECT name FROM devices WHERE api_token = ?"},
+	} {
+		rows, err := devDB.ExecuteQuery(q.sql, hash)
+		if err != nil {
+			return "", "", false, err
+		}
+		found := rows.Next()
+		if found {
+			err = rows.Scan(&name)
+		}
+		rows.Close()
+		if err != nil {
+			return "", "", false, err
+		}
+		if found {
+			return q.kind, name, true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		// InfluxDB clients send "Token <token>"
+		if token, ok = strings.CutPrefix(header, "Token "); !ok {
+			return ""
+		}
+	}
+	return strings.TrimSpace(token)
+}
+
+// RequireToken is the middleware for routes that need a device or, if admin
+// is set, an admin token. It does nothing unless HTTPAuth is enabled.
+func (s *IoTEdge) RequireToken(admin bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.IoTConfig.HTTPAuth || c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		logFields := log.Fields{"fnct": "RequireToken", "path": c.FullPath()}
+		token := bearerToken(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+			return
+		}
+		kind, name, ok, err := s.DeviceDB.LookupToken(token)
+		if err != nil {
+			log.WithFields(logFields).Errorf("token lookup failed: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("token lookup failed: %v", err)})
+			return
+		}
+		if !ok {
+			log.WithFields(logFields).Warnf("Invalid token from %s", c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+		if admin && kind != tokenKindAdmin {
+			log.WithFields(logFields).Warnf("Device %s tried to access admin route", name)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin token required"})
+			return
+		}
+		c.Set("tokenKind", kind)
+		c.Set("tokenName", name)
+		c.Next()
+	}
+}
+
+// tokenDevice returns the device of the request's token. restricted is false
+// without HTTPAuth and for admin tokens, which may write every tag.
+func tokenDevice(c *gin.Context, httpAuth bool) (name string, restricted bool) {
+	if !httpAuth || c.GetString("tokenKind") != tokenKindDevice {
+		return "", false
+	}
+	return c.GetString("tokenName"), true
+}
+
+// mayWriteTags answers 403 unless every tag is a sensor of the token's
+// device.
+func (s *IoTEdge) mayWriteTags(c *gin.Context, tags []string) bool {
+	name, restricted := tokenDevice(c, s.IoTConfig.HTTPAuth)
+	if !restricted {
+		return true
+	}
+	logFields := log.Fields{"fnct": "mayWriteTags", "device": name}
+	dev, err := s.DeviceDB.GetDevice(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getting device failed: %v", err)})
+		return false
+	}
+	for _, tag := range tags {
+		own, err := s.DeviceDB.SensorOfDevice(tag, dev.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("getting sensor failed: %v", err)})
+			return false
+		}
+		if !own {
+			log.WithFields(logFields).Warnf("Device tried to write tag %s", tag)
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("tag %s is no sensor of device %s", tag, name)})
+			return false
+		}
+	}
+	return true
+}
+
+// mayWriteLogs answers 403 unless every message is from the token's device.
+func (s *IoTEdge) mayWriteLogs(c *gin.Context, msgs []LogMessage) bool {
+	name, restricted := tokenDevice(c, s.IoTConfig.HTTPAuth)
+	if !restricted {
+		return true
+	}
+	for _, msg := range msgs {
+		if msg.Device != name {
+			log.WithFields(log.Fields{"fnct": "mayWriteLogs", "device": name}).
+				Warnf("Device tried to log as %s", msg.Device)
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("message of %s can't be logged by device %s", msg.Device, name)})
+			return false
+		}
+	}
+	return true
+}
+
+// mayInitDevice lets unknown devices initialize themselves. Devices with a
+// token have to present it, known devices without token (revoked or
+// registered before HTTPAuth was enabled) need an admin token.
+func (s *IoTEdge) mayInitDevice(c *gin.Context, name string) (bool, error) {
+	if !s.IoTConfig.HTTPAuth {
+		return true, nil
+	}
+	known, hasToken, err := s.DeviceDB.deviceTokenState(name)
+	if err != nil || !known {
+		return !known, err
+	}
+	kind, tokenName, ok, err := s.DeviceDB.LookupToken(bearerToken(c))
+	if err != nil {
+		return false, err
+	}
+	return ok && (kind == tokenKindAdmin || hasToken && tokenName == name), nil
+}